@@ -0,0 +1,33 @@
+package allocation
+
+import (
+	"errors"
+
+	"github.com/cybertec-postgresql/yaim/config"
+	"github.com/cybertec-postgresql/yaim/dcs"
+)
+
+// ErrUnsupportedStrategy is returned for an unsupported allocation strategy
+var ErrUnsupportedStrategy = errors.New("given allocation strategy not supported")
+
+// Strategy decides which node should hold each IP address in the pool.
+// All nodes compute the assignment on their own, so given the same state, they need to come to the same result.
+type Strategy interface {
+	// Assign returns the target node of each IP address, IP addresses without a target are left out.
+	Assign(state *dcs.PoolState) (targets map[string]string)
+}
+
+// NewStrategy returns a new Strategy instance depending on the configuration
+func NewStrategy(conf *config.Config) (Strategy, error) {
+	var s Strategy
+	var err error
+
+	switch conf.AllocationStrategy {
+	case "balanced":
+		s, err = NewBalancedStrategy(conf)
+	default:
+		err = ErrUnsupportedStrategy
+	}
+
+	return s, err
+}
@@ -0,0 +1,228 @@
+package allocation
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/cybertec-postgresql/yaim/config"
+	"github.com/cybertec-postgresql/yaim/dcs"
+)
+
+// BalancedStrategy distributes the IP addresses among all available nodes in proportion to their weight,
+// while moving as few addresses as possible:
+// nodes keep the addresses they already hold up to their share,
+// only the remaining addresses are assigned to the nodes with the most free capacity.
+// Nodes never get more addresses than their limit, if there are more addresses than all nodes can take, some are left without a target.
+//
+// Addresses with an affinity are put on one of the matching nodes first, even beyond its share.
+// Only if no matching node is available, they are distributed like all other addresses.
+// Addresses in the same anti-affinity group are never put on the same node, even if that leaves some of them without a target.
+type BalancedStrategy struct {
+	conf *config.Config
+}
+
+func NewBalancedStrategy(conf *config.Config) (*BalancedStrategy, error) {
+	if conf.Weight < 1 {
+		return nil, errors.New("weight needs to be at least 1")
+	}
+	if conf.MaxIPs < 0 {
+		return nil, errors.New("max-ips must not be negative")
+	}
+	return &BalancedStrategy{conf: conf}, nil
+}
+
+// assignment keeps track of the targets while they are being computed.
+type assignment struct {
+	info     map[string]dcs.NodeInfo
+	specs    map[string]config.IPSpec
+	targets  map[string]string
+	assigned map[string]int
+	groups   map[string]map[string]bool // anti-affinity groups on each node
+}
+
+// fits returns true if the node may take the address without exceeding its limit or violating anti-affinity.
+func (a *assignment) fits(node string, ip string) bool {
+	if max := a.info[node].MaxIPs; max > 0 && a.assigned[node] >= max {
+		return false
+	}
+	group := a.specs[ip].AntiAffinity
+	return group == "" || !a.groups[node][group]
+}
+
+func (a *assignment) assign(node string, ip string) {
+	a.targets[ip] = node
+	a.assigned[node]++
+	if group := a.specs[ip].AntiAffinity; group != "" {
+		if a.groups[node] == nil {
+			a.groups[node] = make(map[string]bool)
+		}
+		a.groups[node][group] = true
+	}
+}
+
+// matches returns true if the node has all the tags the address prefers.
+func (a *assignment) matches(node string, ip string) bool {
+	for k, v := range a.specs[ip].Affinity {
+		if k == "name" {
+			if node != v {
+				return false
+			}
+		} else if a.info[node].Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *BalancedStrategy) Assign(state *dcs.PoolState) (targets map[string]string) {
+	nodes := state.Available()
+	a := &assignment{
+		info:     make(map[string]dcs.NodeInfo),
+		specs:    make(map[string]config.IPSpec),
+		targets:  make(map[string]string),
+		assigned: make(map[string]int),
+		groups:   make(map[string]map[string]bool),
+	}
+	if len(nodes) == 0 {
+		return a.targets
+	}
+	for _, n := range state.Nodes {
+		a.info[n.Name] = n.Info()
+	}
+
+	ips := make([]dcs.IPState, len(state.IPs))
+	copy(ips, state.IPs)
+	sort.Slice(ips, func(i, j int) bool { return ips[i].IP < ips[j].IP })
+
+	held := make(map[string]int)
+	for _, ip := range ips {
+		held[ip.Holder]++
+		if ip.Spec != "" {
+			// invalid specs are ignored, just like in the DCS connectors.
+			if spec, err := config.ParseIPSpec(ip.Spec); err == nil {
+				a.specs[ip.IP] = spec
+			}
+		}
+	}
+	quota := quotas(a.info, nodes, held, len(ips))
+
+	// addresses with an affinity go to a matching node first, preferably the one already holding it.
+	var unpinned []dcs.IPState
+	for _, ip := range ips {
+		if len(a.specs[ip.IP].Affinity) == 0 {
+			unpinned = append(unpinned, ip)
+			continue
+		}
+		target := ""
+		for _, node := range nodes {
+			if !a.matches(node, ip.IP) || !a.fits(node, ip.IP) {
+				continue
+			}
+			if node == ip.Holder {
+				target = node
+				break
+			}
+			if target == "" || a.assigned[node] < a.assigned[target] {
+				target = node
+			}
+		}
+		if target == "" {
+			unpinned = append(unpinned, ip)
+			continue
+		}
+		a.assign(target, ip.IP)
+	}
+
+	// nodes keep the addresses they already hold, up to their share.
+	var remaining []dcs.IPState
+	for _, ip := range unpinned {
+		if ip.Holder != "" && a.assigned[ip.Holder] < quota[ip.Holder] && a.fits(ip.Holder, ip.IP) {
+			a.assign(ip.Holder, ip.IP)
+			continue
+		}
+		remaining = append(remaining, ip)
+	}
+
+	for _, ip := range remaining {
+		// a node that has already claimed the address is ready to take it over.
+		if ip.Claim != "" && a.assigned[ip.Claim] < quota[ip.Claim] && a.fits(ip.Claim, ip.IP) {
+			a.assign(ip.Claim, ip.IP)
+			continue
+		}
+		// the addresses taken by affinity might leave no node with a free share, so the most free share wins, even if it is negative.
+		target := ""
+		for _, node := range nodes {
+			if !a.fits(node, ip.IP) {
+				continue
+			}
+			if target == "" || quota[node]-a.assigned[node] > quota[target]-a.assigned[target] {
+				target = node
+			}
+		}
+		if target == "" {
+			// all nodes have reached their limit, or already hold an address of the same anti-affinity group.
+			continue
+		}
+		a.assign(target, ip.IP)
+	}
+	return a.targets
+}
+
+// quotas returns the number of addresses each node should hold.
+// The addresses are shared in proportion to the weight of the nodes, the shares of nodes that exceed their limit are
+// capped and the rest is shared among the remaining nodes again.
+// Rounding leftovers go to the nodes with the largest fractional share, then to the ones already holding the most addresses,
+// so they don't need to be moved around.
+func quotas(info map[string]dcs.NodeInfo, nodes []string, held map[string]int, numIPs int) map[string]int {
+	quota := make(map[string]int)
+	active := nodes
+	remaining := numIPs
+	shares := make(map[string]float64)
+	for {
+		weights := 0
+		for _, node := range active {
+			weights += info[node].Weight
+		}
+		var uncapped []string
+		for _, node := range active {
+			shares[node] = float64(remaining) * float64(info[node].Weight) / float64(weights)
+			if info[node].MaxIPs > 0 && shares[node] >= float64(info[node].MaxIPs) {
+				quota[node] = info[node].MaxIPs
+				continue
+			}
+			uncapped = append(uncapped, node)
+		}
+		if len(uncapped) == len(active) {
+			break
+		}
+		for _, node := range active {
+			if _, capped := quota[node]; capped {
+				remaining -= quota[node]
+			}
+		}
+		active = uncapped
+		if len(active) == 0 {
+			return quota
+		}
+	}
+
+	leftover := remaining
+	for _, node := range active {
+		quota[node] = int(math.Floor(shares[node]))
+		leftover -= quota[node]
+	}
+	byShare := make([]string, len(active))
+	copy(byShare, active)
+	sort.SliceStable(byShare, func(i, j int) bool {
+		a, b := shares[byShare[i]]-math.Floor(shares[byShare[i]]), shares[byShare[j]]-math.Floor(shares[byShare[j]])
+		if a != b {
+			return a > b
+		}
+		return held[byShare[i]] > held[byShare[j]]
+	})
+	for i := 0; i < leftover && i < len(byShare); i++ {
+		quota[byShare[i]]++
+	}
+	return quota
+}
@@ -0,0 +1,310 @@
+package allocation
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/cybertec-postgresql/yaim/config"
+	"github.com/cybertec-postgresql/yaim/dcs"
+)
+
+// node returns the state of a node advertising info.
+func node(name string, info dcs.NodeInfo) dcs.NodeState {
+	value, _ := json.Marshal(info)
+	return dcs.NodeState{Name: name, Value: string(value)}
+}
+
+// nodes returns the state of nodes advertising a weight of 1 without a limit.
+func nodes(names ...string) []dcs.NodeState {
+	var states []dcs.NodeState
+	for _, name := range names {
+		states = append(states, node(name, dcs.NodeInfo{Weight: 1}))
+	}
+	return states
+}
+
+// pool returns n unmarked addresses, 10.0.0.1 to 10.0.0.n.
+func pool(n int) []dcs.IPState {
+	var ips []dcs.IPState
+	for i := 1; i <= n; i++ {
+		ips = append(ips, dcs.IPState{IP: fmt.Sprintf("10.0.0.%d", i)})
+	}
+	return ips
+}
+
+// held marks the addresses of the pool in order, the first counts[0] by holders[0] and so on.
+func held(ips []dcs.IPState, holders []string, counts []int) []dcs.IPState {
+	i := 0
+	for h, holder := range holders {
+		for n := 0; n < counts[h]; n++ {
+			ips[i].Holder = holder
+			i++
+		}
+	}
+	return ips
+}
+
+// count returns the number of addresses assigned to each node, "" counts the addresses without a target.
+func count(state *dcs.PoolState, targets map[string]string) map[string]int {
+	counts := make(map[string]int)
+	for _, ip := range state.IPs {
+		counts[targets[ip.IP]]++
+	}
+	return counts
+}
+
+func assign(t *testing.T, state *dcs.PoolState) map[string]string {
+	t.Helper()
+	s, err := NewBalancedStrategy(&config.Config{Weight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.Assign(state)
+}
+
+func TestBalancedAssignIsDeterministic(t *testing.T) {
+	state := &dcs.PoolState{
+		IPs: held(pool(10), []string{"b", "c"}, []int{4, 2}),
+		Nodes: []dcs.NodeState{
+			node("a", dcs.NodeInfo{Weight: 2}),
+			node("b", dcs.NodeInfo{Weight: 1, MaxIPs: 3}),
+			node("c", dcs.NodeInfo{Weight: 1, Tags: map[string]string{"zone": "x"}}),
+		},
+	}
+	state.IPs[7].Spec = `{"affinity": {"zone": "x"}}`
+	state.IPs[8].Spec = `{"anti-affinity": "db"}`
+	state.IPs[9].Spec = `{"anti-affinity": "db"}`
+
+	want := assign(t, state)
+
+	// the DCS might list addresses and nodes in any order.
+	reversed := &dcs.PoolState{}
+	for i := len(state.IPs) - 1; i >= 0; i-- {
+		reversed.IPs = append(reversed.IPs, state.IPs[i])
+	}
+	for i := len(state.Nodes) - 1; i >= 0; i-- {
+		reversed.Nodes = append(reversed.Nodes, state.Nodes[i])
+	}
+
+	for i := 0; i < 10; i++ {
+		if got := assign(t, state); !reflect.DeepEqual(got, want) {
+			t.Fatalf("assignment changed for the same state: got %v, want %v", got, want)
+		}
+		if got := assign(t, reversed); !reflect.DeepEqual(got, want) {
+			t.Fatalf("assignment depends on the order of the state: got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBalancedAssignMovesFewAddresses(t *testing.T) {
+	tests := []struct {
+		name       string
+		holders    []string
+		held       []int
+		nodes      []string
+		wantCounts map[string]int
+		wantMoved  int
+	}{
+		{
+			name:       "balanced pool stays put",
+			holders:    []string{"a", "b", "c"},
+			held:       []int{4, 3, 3},
+			nodes:      []string{"a", "b", "c"},
+			wantCounts: map[string]int{"a": 4, "b": 3, "c": 3},
+			wantMoved:  0,
+		},
+		{
+			name:       "node joins",
+			holders:    []string{"a", "b"},
+			held:       []int{5, 5},
+			nodes:      []string{"a", "b", "c"},
+			wantCounts: map[string]int{"a": 4, "b": 3, "c": 3},
+			wantMoved:  3,
+		},
+		{
+			name:       "fourth node joins",
+			holders:    []string{"a", "b", "c"},
+			held:       []int{4, 3, 3},
+			nodes:      []string{"a", "b", "c", "d"},
+			wantCounts: map[string]int{"a": 3, "b": 3, "c": 2, "d": 2},
+			wantMoved:  2,
+		},
+		{
+			name:       "node leaves",
+			holders:    []string{"a", "b", "c"},
+			held:       []int{4, 3, 3},
+			nodes:      []string{"a", "b"},
+			wantCounts: map[string]int{"a": 5, "b": 5},
+			wantMoved:  3,
+		},
+		{
+			name:       "unmarked pool",
+			nodes:      []string{"a", "b", "c"},
+			wantCounts: map[string]int{"a": 4, "b": 3, "c": 3},
+			wantMoved:  10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &dcs.PoolState{IPs: held(pool(10), tt.holders, tt.held), Nodes: nodes(tt.nodes...)}
+
+			targets := assign(t, state)
+
+			if got := count(state, targets); !reflect.DeepEqual(got, tt.wantCounts) {
+				t.Errorf("got %v addresses per node, want %v", got, tt.wantCounts)
+			}
+			moved := 0
+			for _, ip := range state.IPs {
+				if targets[ip.IP] != ip.Holder {
+					moved++
+				}
+			}
+			if moved != tt.wantMoved {
+				t.Errorf("moved %d addresses, want %d: %v", moved, tt.wantMoved, targets)
+			}
+		})
+	}
+}
+
+func TestBalancedAssign(t *testing.T) {
+	tests := []struct {
+		name        string
+		state       *dcs.PoolState
+		wantCounts  map[string]int
+		wantTargets map[string]string
+	}{
+		{
+			name: "claiming node takes over from a node in maintenance",
+			state: &dcs.PoolState{
+				IPs: []dcs.IPState{
+					{IP: "10.0.0.1", Holder: "a", Claim: "c"},
+					{IP: "10.0.0.2", Holder: "a"},
+				},
+				Nodes:       nodes("a", "b", "c"),
+				Maintenance: []string{"a"},
+			},
+			wantTargets: map[string]string{"10.0.0.1": "c", "10.0.0.2": "b"},
+		},
+		{
+			name: "claim of a node without a free share is ignored",
+			state: &dcs.PoolState{
+				IPs: []dcs.IPState{
+					{IP: "10.0.0.1", Holder: "c"},
+					{IP: "10.0.0.2", Holder: "c"},
+					{IP: "10.0.0.3", Holder: "a", Claim: "c"},
+				},
+				Nodes:       nodes("a", "b", "c"),
+				Maintenance: []string{"a"},
+			},
+			wantTargets: map[string]string{"10.0.0.1": "c", "10.0.0.2": "c", "10.0.0.3": "b"},
+		},
+		{
+			name: "weight",
+			state: &dcs.PoolState{
+				IPs:   pool(8),
+				Nodes: []dcs.NodeState{node("a", dcs.NodeInfo{Weight: 3}), node("b", dcs.NodeInfo{Weight: 1})},
+			},
+			wantCounts: map[string]int{"a": 6, "b": 2},
+		},
+		{
+			name: "max-ips caps the share of a node",
+			state: &dcs.PoolState{
+				IPs: pool(10),
+				Nodes: []dcs.NodeState{
+					node("a", dcs.NodeInfo{Weight: 1, MaxIPs: 2}),
+					node("b", dcs.NodeInfo{Weight: 1}),
+					node("c", dcs.NodeInfo{Weight: 1}),
+				},
+			},
+			wantCounts: map[string]int{"a": 2, "b": 4, "c": 4},
+		},
+		{
+			name: "max-ips leaves addresses without a target",
+			state: &dcs.PoolState{
+				IPs:   pool(5),
+				Nodes: []dcs.NodeState{node("a", dcs.NodeInfo{Weight: 1, MaxIPs: 1}), node("b", dcs.NodeInfo{Weight: 1, MaxIPs: 2})},
+			},
+			wantCounts: map[string]int{"a": 1, "b": 2, "": 2},
+		},
+		{
+			name: "affinity goes beyond the share of the matching node",
+			state: &dcs.PoolState{
+				IPs: []dcs.IPState{
+					{IP: "10.0.0.1", Spec: `{"affinity": {"zone": "x"}}`},
+					{IP: "10.0.0.2", Spec: `{"affinity": {"zone": "x"}}`},
+					{IP: "10.0.0.3", Spec: `{"affinity": {"name": "a"}}`},
+					{IP: "10.0.0.4"},
+				},
+				Nodes: []dcs.NodeState{
+					node("a", dcs.NodeInfo{Weight: 1}),
+					node("b", dcs.NodeInfo{Weight: 1, Tags: map[string]string{"zone": "x"}}),
+				},
+			},
+			wantTargets: map[string]string{"10.0.0.1": "b", "10.0.0.2": "b", "10.0.0.3": "a", "10.0.0.4": "a"},
+		},
+		{
+			name: "affinity without a matching node is ignored",
+			state: &dcs.PoolState{
+				IPs: []dcs.IPState{
+					{IP: "10.0.0.1", Spec: `{"affinity": {"zone": "y"}}`},
+					{IP: "10.0.0.2", Spec: `{"affinity": {"zone": "y"}}`},
+				},
+				Nodes: []dcs.NodeState{
+					node("a", dcs.NodeInfo{Weight: 1}),
+					node("b", dcs.NodeInfo{Weight: 1, Tags: map[string]string{"zone": "x"}}),
+				},
+			},
+			wantCounts: map[string]int{"a": 1, "b": 1},
+		},
+		{
+			name: "anti-affinity spreads a group across nodes",
+			state: &dcs.PoolState{
+				IPs: []dcs.IPState{
+					{IP: "10.0.0.1", Holder: "a", Spec: `{"anti-affinity": "db"}`},
+					{IP: "10.0.0.2", Holder: "a", Spec: `{"anti-affinity": "db"}`},
+					{IP: "10.0.0.3", Holder: "a"},
+					{IP: "10.0.0.4", Holder: "a"},
+				},
+				Nodes: nodes("a", "b"),
+			},
+			wantTargets: map[string]string{"10.0.0.1": "a", "10.0.0.2": "b", "10.0.0.3": "a", "10.0.0.4": "b"},
+		},
+		{
+			name: "anti-affinity leaves addresses without a target",
+			state: &dcs.PoolState{
+				IPs: []dcs.IPState{
+					{IP: "10.0.0.1", Spec: `{"anti-affinity": "db"}`},
+					{IP: "10.0.0.2", Spec: `{"anti-affinity": "db"}`},
+					{IP: "10.0.0.3", Spec: `{"anti-affinity": "db"}`},
+				},
+				Nodes: nodes("a", "b"),
+			},
+			wantCounts: map[string]int{"a": 1, "b": 1, "": 1},
+		},
+		{
+			name: "no available nodes",
+			state: &dcs.PoolState{
+				IPs:         held(pool(2), []string{"a"}, []int{2}),
+				Nodes:       nodes("a"),
+				Maintenance: []string{"a"},
+			},
+			wantCounts: map[string]int{"": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := assign(t, tt.state)
+
+			if tt.wantCounts != nil {
+				if got := count(tt.state, targets); !reflect.DeepEqual(got, tt.wantCounts) {
+					t.Errorf("got %v addresses per node, want %v: %v", got, tt.wantCounts, targets)
+				}
+			}
+			if tt.wantTargets != nil && !reflect.DeepEqual(targets, tt.wantTargets) {
+				t.Errorf("got targets %v, want %v", targets, tt.wantTargets)
+			}
+		})
+	}
+}
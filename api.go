@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/yaim/config"
+	"github.com/cybertec-postgresql/yaim/dcs"
+	"github.com/cybertec-postgresql/yaim/notify"
+)
+
+// status is what the main loop last found out about this node, as reported by the API.
+type status struct {
+	Nodename string `json:"nodename"`
+
+	Healthy    bool      `json:"healthy"`
+	Successes  int       `json:"successes"` // consecutive successful checks
+	Failures   int       `json:"failures"`  // consecutive failed checks
+	CheckError string    `json:"check-error,omitempty"`
+	LastCheck  time.Time `json:"last-check"`
+
+	OwnedIPs []string `json:"owned-ips"` // registered on the interfaces of this node
+
+	DcsConnected   bool      `json:"dcs-connected"`
+	DcsError       string    `json:"dcs-error,omitempty"`
+	LastDcsSuccess time.Time `json:"last-dcs-success"`
+
+	LastLoop time.Time `json:"last-loop"`
+}
+
+// api serves the status of this node and allows to drain, resume or resync it,
+// either on a TCP address or on a unix socket.
+type api struct {
+	address  string
+	nodename string
+	admin    dcs.Admin
+	resync   chan struct{}
+
+	mu       sync.Mutex
+	status   status
+	settings map[string]interface{}
+}
+
+func newAPI(conf *config.Config, admin dcs.Admin) *api {
+	a := &api{
+		address:  conf.ApiAddress,
+		nodename: conf.Nodename,
+		admin:    admin,
+		resync:   make(chan struct{}, 1),
+	}
+	a.status.Nodename = conf.Nodename
+	a.status.OwnedIPs = []string{}
+	a.setConfig(conf)
+	return a
+}
+
+// setConfig takes a copy of the settings, as the configuration may be reloaded while they are being served.
+func (a *api) setConfig(conf *config.Config) {
+	settings := config.MaskedSettings(conf)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.settings = settings
+}
+
+// update changes the status while holding the lock.
+func (a *api) update(f func(s *status)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f(&a.status)
+}
+
+// serve opens the listener right away, so that errors can be reported during startup.
+func (a *api) serve() error {
+	network, address := "tcp", a.address
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+		// a socket left behind by a previous run would make listening fail.
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		err = os.Chmod(address, 0660)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.handleStatus)
+	mux.HandleFunc("/config", a.handleConfig)
+	mux.HandleFunc("/drain", a.handleMaintenance(true))
+	mux.HandleFunc("/resume", a.handleMaintenance(false))
+	mux.HandleFunc("/resync", a.handleResync)
+	go func() {
+		err := http.Serve(listener, mux)
+		log.Error("API listener stopped:")
+		log.Error(err)
+	}()
+	log.Print("Serving API on: ", a.address)
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Error("Error while writing API response:")
+		log.Error(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed, use " + method})
+		return false
+	}
+	return true
+}
+
+func (a *api) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	a.mu.Lock()
+	s := a.status
+	a.mu.Unlock()
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (a *api) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	a.mu.Lock()
+	settings := a.settings
+	a.mu.Unlock()
+	writeJSON(w, http.StatusOK, settings)
+}
+
+// handleMaintenance puts this node into maintenance or takes it out again, just like yaimctl drain and resume.
+func (a *api) handleMaintenance(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err := a.admin.SetMaintenance(a.nodename, enabled)
+		if err != nil {
+			log.Error("Error while changing maintenance of this node through the API:")
+			log.Error(err)
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		log.Print("Maintenance of this node changed through the API, enabled: ", enabled)
+		notify.Send(a.resync)
+		writeJSON(w, http.StatusOK, map[string]bool{"maintenance": enabled})
+	}
+}
+
+func (a *api) handleResync(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	log.Print("Resync requested through the API.")
+	notify.Send(a.resync)
+	writeJSON(w, http.StatusAccepted, map[string]bool{"resync": true})
+}
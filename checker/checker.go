@@ -2,6 +2,7 @@ package checker
 
 import (
 	"errors"
+	"time"
 
 	"github.com/cybertec-postgresql/yaim/config"
 )
@@ -22,12 +23,16 @@ func NewChecker(conf *config.Config) (Checker, error) {
 	var err error
 
 	switch conf.CheckerType {
-	// case "postgres":
-	// 	c, err = NewPostgresChecker(con)
-	// case "shell":
-	// 	c, err = NewShellChecker(con)
+	case "postgres":
+		c, err = NewPostgresChecker(conf)
+	case "shell":
+		c, err = NewShellChecker(conf)
 	case "http":
 		c, err = NewHttpChecker(conf)
+	case "tcp":
+		c, err = NewTcpChecker(conf)
+	case "composite":
+		c, err = NewCompositeChecker(conf)
 	default:
 		err = ErrUnsupportedCheckerType
 	}
@@ -35,6 +40,42 @@ func NewChecker(conf *config.Config) (Checker, error) {
 	return c, err
 }
 
+// ErrNoTimeout is returned by MaxDuration for checkers that can take arbitrarily long
+var ErrNoTimeout = errors.New("the http checker has no timeout")
+
+// MaxDuration returns how long a single check can take at most, according to the timeouts in the configuration
+func MaxDuration(conf *config.Config) (time.Duration, error) {
+	switch conf.CheckerType {
+	case "postgres":
+		return time.Duration(conf.PostgresConnectTimeout+conf.PostgresStatementTimeout) * time.Millisecond, nil
+	case "shell":
+		return time.Duration(conf.ShellTimeout)*time.Millisecond + shellWaitDelay, nil
+	case "tcp":
+		return time.Duration(conf.TcpTimeout) * time.Millisecond, nil
+	case "http":
+		return 0, ErrNoTimeout
+	case "composite":
+		// the checkers are run concurrently, so the slowest one counts.
+		confs, err := conf.CheckerConfigs()
+		if err != nil {
+			return 0, err
+		}
+		var max time.Duration
+		for _, childConf := range confs {
+			d, err := MaxDuration(childConf)
+			if err != nil {
+				return 0, err
+			}
+			if d > max {
+				max = d
+			}
+		}
+		return max, nil
+	default:
+		return 0, ErrUnsupportedCheckerType
+	}
+}
+
 // func (c *Checker) checkLoop(ctx context.Context, out chan<- bool) error {
 // 	for {
 // 		if ctx.Err() != nil {
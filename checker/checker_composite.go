@@ -0,0 +1,116 @@
+package checker
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cybertec-postgresql/yaim/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// CompositeChecker combines the results of several other checkers.
+// Depending on composite-mode, all of them, any of them or at least N of them need to be healthy.
+type CompositeChecker struct {
+	conf     *config.Config
+	names    []string
+	checkers []Checker
+	required int
+	results  []bool
+}
+
+func NewCompositeChecker(conf *config.Config) (*CompositeChecker, error) {
+	var c = new(CompositeChecker)
+	c.conf = conf
+
+	confs, err := conf.CheckerConfigs()
+	if err != nil {
+		return nil, err
+	}
+	if len(confs) == 0 {
+		return nil, errors.New("checkers needs to contain at least one checker when using the composite checker")
+	}
+	for i, childConf := range confs {
+		if childConf.CheckerType == "composite" {
+			return nil, errors.New("the composite checker can't contain another composite checker")
+		}
+		child, err := NewChecker(childConf)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create checker %d (%s): %w", i+1, childConf.CheckerType, err)
+		}
+		c.names = append(c.names, fmt.Sprintf("%d (%s)", i+1, childConf.CheckerType))
+		c.checkers = append(c.checkers, child)
+	}
+	c.results = make([]bool, len(c.checkers))
+
+	switch {
+	case conf.CompositeMode == "all":
+		c.required = len(c.checkers)
+	case conf.CompositeMode == "any":
+		c.required = 1
+	case strings.HasPrefix(conf.CompositeMode, "at-least-"):
+		c.required, err = strconv.Atoi(strings.TrimPrefix(conf.CompositeMode, "at-least-"))
+		if err != nil || c.required < 1 || c.required > len(c.checkers) {
+			return nil, fmt.Errorf("composite-mode %s needs to be between at-least-1 and at-least-%d", conf.CompositeMode, len(c.checkers))
+		}
+	default:
+		return nil, errors.New("composite-mode needs to be one of all, any or at-least-N, not: " + conf.CompositeMode)
+	}
+
+	return c, nil
+}
+
+// Check runs all checkers concurrently.
+// Checkers that failed with an error count as unhealthy, the errors are returned combined.
+func (c *CompositeChecker) Check() error {
+	errs := make([]error, len(c.checkers))
+
+	var wg sync.WaitGroup
+	for i := range c.checkers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.results[i], errs[i] = c.checkers[i].IsHealthy()
+		}(i)
+	}
+	wg.Wait()
+
+	var msgs []string
+	for i := range c.checkers {
+		if errs[i] != nil {
+			log.Print("Checker ", c.names[i], " encountered an error: ", errs[i])
+			msgs = append(msgs, "checker "+c.names[i]+": "+errs[i].Error())
+		} else if c.results[i] {
+			log.Print("Checker ", c.names[i], " is healthy.")
+		} else {
+			log.Print("Checker ", c.names[i], " is not healthy.")
+		}
+	}
+	if len(msgs) > 0 {
+		return errors.New(strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+func (c *CompositeChecker) CompareExpected() bool {
+	healthy := 0
+	for _, result := range c.results {
+		if result {
+			healthy++
+		}
+	}
+	log.Debug(healthy, " of ", len(c.checkers), " checkers are healthy, ", c.required, " are required.")
+	return healthy >= c.required
+}
+
+// IsHealthy only returns an error if the errors of the checkers made a difference,
+// so the health check will be retried only then.
+func (c *CompositeChecker) IsHealthy() (bool, error) {
+	err := c.Check()
+	if c.CompareExpected() {
+		return true, nil
+	}
+	return false, err
+}
@@ -0,0 +1,104 @@
+package checker
+
+import (
+	"testing"
+
+	"github.com/cybertec-postgresql/yaim/config"
+)
+
+// compositeConf returns the configuration of a composite checker combining n tcp checkers.
+func compositeConf(mode string, n int) *config.Config {
+	conf := &config.Config{CheckerType: "composite", CompositeMode: mode}
+	for i := 0; i < n; i++ {
+		conf.Checkers = append(conf.Checkers, map[string]interface{}{"checker-type": "tcp", "tcp-address": "127.0.0.1:5432"})
+	}
+	return conf
+}
+
+func TestNewCompositeCheckerMode(t *testing.T) {
+	tests := []struct {
+		mode         string
+		wantRequired int
+		wantErr      bool
+	}{
+		{mode: "all", wantRequired: 3},
+		{mode: "any", wantRequired: 1},
+		{mode: "at-least-1", wantRequired: 1},
+		{mode: "at-least-3", wantRequired: 3},
+		{mode: "at-least-0", wantErr: true},
+		{mode: "at-least-4", wantErr: true},
+		{mode: "at-least-", wantErr: true},
+		{mode: "at-least-two", wantErr: true},
+		{mode: "most", wantErr: true},
+		{mode: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			c, err := NewCompositeChecker(compositeConf(tt.mode, 3))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("composite-mode %q accepted, requiring %d checkers", tt.mode, c.required)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.required != tt.wantRequired {
+				t.Errorf("got %d required checkers, want %d", c.required, tt.wantRequired)
+			}
+		})
+	}
+}
+
+func TestNewCompositeCheckerCheckers(t *testing.T) {
+	tests := []struct {
+		name string
+		conf *config.Config
+	}{
+		{
+			name: "no checkers",
+			conf: compositeConf("all", 0),
+		},
+		{
+			name: "nested composite checker",
+			conf: &config.Config{CheckerType: "composite", CompositeMode: "all", Checkers: []map[string]interface{}{{"checker-type": "composite"}}},
+		},
+		{
+			name: "unsupported checker",
+			conf: &config.Config{CheckerType: "composite", CompositeMode: "all", Checkers: []map[string]interface{}{{"checker-type": "ping"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewCompositeChecker(tt.conf); err == nil {
+				t.Error("configuration accepted")
+			}
+		})
+	}
+}
+
+func TestCompositeCheckerCompareExpected(t *testing.T) {
+	tests := []struct {
+		mode    string
+		results []bool
+		want    bool
+	}{
+		{mode: "all", results: []bool{true, true, true}, want: true},
+		{mode: "all", results: []bool{true, false, true}, want: false},
+		{mode: "any", results: []bool{false, false, true}, want: true},
+		{mode: "any", results: []bool{false, false, false}, want: false},
+		{mode: "at-least-2", results: []bool{true, false, true}, want: true},
+		{mode: "at-least-2", results: []bool{false, false, true}, want: false},
+	}
+	for _, tt := range tests {
+		c, err := NewCompositeChecker(compositeConf(tt.mode, len(tt.results)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(c.results, tt.results)
+		if got := c.CompareExpected(); got != tt.want {
+			t.Errorf("%s with results %v: got %t, want %t", tt.mode, tt.results, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package checker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/cybertec-postgresql/yaim/config"
+	"github.com/jackc/pgx/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+type PostgresChecker struct {
+	conf    *config.Config
+	connCfg *pgx.ConnConfig
+	result  string
+}
+
+func NewPostgresChecker(conf *config.Config) (*PostgresChecker, error) {
+	var c = new(PostgresChecker)
+	c.conf = conf
+
+	if c.conf.PostgresQuery == "" {
+		return nil, errors.New("postgres-query needs to be set when using the postgres checker")
+	}
+
+	connCfg, err := pgx.ParseConfig(c.conf.PostgresConnUrl)
+	if err != nil {
+		return nil, err
+	}
+	if c.conf.PostgresUser != "" {
+		connCfg.User = c.conf.PostgresUser
+	}
+	if c.conf.PostgresPassword != "" {
+		connCfg.Password = c.conf.PostgresPassword
+	}
+	connCfg.ConnectTimeout = time.Duration(c.conf.PostgresConnectTimeout) * time.Millisecond
+	// the server will cancel the query on its own, should it take too long.
+	connCfg.RuntimeParams["statement_timeout"] = fmt.Sprint(c.conf.PostgresStatementTimeout)
+
+	if c.conf.PostgresCAFile != "" || c.conf.PostgresCertFile != "" {
+		err := c.configureTLS(connCfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.connCfg = connCfg
+
+	return c, nil
+}
+
+// configureTLS adds the CA and client certificate to the TLS configurations that pgx has derived from sslmode,
+// so sslmode still decides whether the connection is encrypted and how the server certificate is verified.
+// The configurations are changed in place, as the verification of sslmode=verify-ca refers to their RootCAs.
+func (c *PostgresChecker) configureTLS(connCfg *pgx.ConnConfig) error {
+	tlsConfigs := []*tls.Config{connCfg.TLSConfig}
+	for _, fallback := range connCfg.Fallbacks {
+		tlsConfigs = append(tlsConfigs, fallback.TLSConfig)
+	}
+
+	var caPool *x509.CertPool
+	if c.conf.PostgresCAFile != "" {
+		caCert, err := ioutil.ReadFile(c.conf.PostgresCAFile)
+		if err != nil {
+			return err
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return errors.New("unable to parse any certificates from postgres-ca-file: " + c.conf.PostgresCAFile)
+		}
+	}
+
+	var certs []tls.Certificate
+	if c.conf.PostgresCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.conf.PostgresCertFile, c.conf.PostgresKeyFile)
+		if err != nil {
+			return err
+		}
+		certs = []tls.Certificate{cert}
+	}
+
+	encrypted := false
+	for _, tlsConfig := range tlsConfigs {
+		if tlsConfig == nil {
+			continue
+		}
+		encrypted = true
+		if caPool != nil {
+			tlsConfig.RootCAs = caPool
+		}
+		if certs != nil {
+			tlsConfig.Certificates = certs
+		}
+	}
+	if !encrypted {
+		log.Warn("postgres-ca-file and postgres-cert-file are ignored, as sslmode=disable doesn't use TLS")
+	}
+	return nil
+}
+
+func (c *PostgresChecker) Check() error {
+	// the timeout covers establishing the connection as well as running the query.
+	timeout := time.Duration(c.conf.PostgresConnectTimeout+c.conf.PostgresStatementTimeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := pgx.ConnectConfig(ctx, c.connCfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	// request the result in text format, so it looks exactly like it would in psql, e.g. "f" for boolean false.
+	rows, err := conn.Query(ctx, c.conf.PostgresQuery, pgx.QueryResultFormats{pgx.TextFormatCode})
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+		return errors.New("the postgres health check query returned no rows")
+	}
+	values := rows.RawValues()
+	if len(values) == 0 {
+		return errors.New("the postgres health check query returned no columns")
+	}
+	c.result = string(values[0])
+
+	log.Debug("The postgres health check query returned: ", c.result)
+
+	return nil
+}
+
+func (c *PostgresChecker) CompareExpected() bool {
+	return c.result == c.conf.PostgresExpectedResponse
+}
+
+func (c *PostgresChecker) IsHealthy() (bool, error) {
+	err := c.Check()
+	if err != nil {
+		return false, err
+	}
+	return c.CompareExpected(), nil
+}
@@ -0,0 +1,96 @@
+package checker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cybertec-postgresql/yaim/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// shellWaitDelay is how long the health check waits for the output of the command after killing it on a timeout.
+// Processes that have left the process group might still hold on to the output, they are no longer waited for.
+const shellWaitDelay = time.Second
+
+type ShellChecker struct {
+	conf     *config.Config
+	exitCode int
+	output   string
+}
+
+func NewShellChecker(conf *config.Config) (*ShellChecker, error) {
+	var c = new(ShellChecker)
+	c.conf = conf
+
+	if c.conf.ShellCommand == "" {
+		return nil, errors.New("shell-command needs to be set when using the shell checker")
+	}
+
+	return c, nil
+}
+
+func (c *ShellChecker) Check() error {
+	var stdout bytes.Buffer
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.conf.ShellTimeout)*time.Millisecond)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.conf.ShellCommand, c.conf.ShellArgs...)
+	cmd.Env = append(os.Environ(), c.conf.ShellEnv...)
+	cmd.Stdout = &stdout
+	// run the command in its own process group,
+	// so we can kill any processes it spawned as well once the timeout is reached.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = shellWaitDelay
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return errors.New("the shell health check command timed out: " + c.conf.ShellCommand)
+	}
+
+	c.exitCode = 0
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return err
+		}
+		c.exitCode = exitErr.ExitCode()
+	}
+	c.output = strings.TrimRight(stdout.String(), "\n")
+
+	log.Debug("The shell health check command exited with code ", c.exitCode, " and returned: ", c.output)
+
+	return nil
+}
+
+func (c *ShellChecker) CompareExpected() bool {
+	//Exit code needs to match expectation
+	//if there is an expectation for the output, that needs to match as well
+	if c.exitCode == c.conf.ShellExpectedExitCode {
+		if c.conf.ShellExpectedOutput != "" {
+			return c.output == c.conf.ShellExpectedOutput
+		}
+		if c.conf.ShellExpectedOutputContains != "" {
+			return strings.Contains(c.output, c.conf.ShellExpectedOutputContains)
+		}
+		return true
+	}
+	return false
+}
+
+func (c *ShellChecker) IsHealthy() (bool, error) {
+	err := c.Check()
+	if err != nil {
+		return false, err
+	}
+	return c.CompareExpected(), nil
+}
@@ -0,0 +1,84 @@
+package checker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/yaim/config"
+)
+
+func TestShellCheckerIsHealthy(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    *config.Config
+		want    bool
+		wantErr bool
+	}{
+		{
+			name: "expected exit code",
+			conf: &config.Config{ShellCommand: "sh", ShellArgs: []string{"-c", "exit 3"}, ShellExpectedExitCode: 3},
+			want: true,
+		},
+		{
+			name: "unexpected exit code",
+			conf: &config.Config{ShellCommand: "false"},
+			want: false,
+		},
+		{
+			name: "expected output",
+			conf: &config.Config{ShellCommand: "echo", ShellArgs: []string{"primary"}, ShellExpectedOutput: "primary"},
+			want: true,
+		},
+		{
+			name: "output contains",
+			conf: &config.Config{ShellCommand: "echo", ShellArgs: []string{"role: replica"}, ShellExpectedOutputContains: "primary"},
+			want: false,
+		},
+		{
+			name:    "timeout",
+			conf:    &config.Config{ShellCommand: "sleep", ShellArgs: []string{"10"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.ShellTimeout = 1000
+			if tt.wantErr {
+				tt.conf.ShellTimeout = 100
+			}
+			c, err := NewShellChecker(tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.IsHealthy()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want an error: %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got healthy %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShellCheckerTimeoutWithEscapedProcess(t *testing.T) {
+	// the background process leaves the process group, so it isn't killed and keeps the output open.
+	c, err := NewShellChecker(&config.Config{
+		ShellCommand: "sh",
+		ShellArgs:    []string{"-c", "setsid sleep 5 & sleep 5"},
+		ShellTimeout: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := time.Now()
+	_, err = c.IsHealthy()
+
+	if err == nil {
+		t.Error("timeout not reported")
+	}
+	if elapsed := time.Since(started); elapsed > 100*time.Millisecond+2*shellWaitDelay {
+		t.Errorf("health check took %s despite the timeout", elapsed)
+	}
+}
@@ -0,0 +1,53 @@
+package checker
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/cybertec-postgresql/yaim/config"
+	log "github.com/sirupsen/logrus"
+)
+
+type TcpChecker struct {
+	conf      *config.Config
+	connected bool
+}
+
+func NewTcpChecker(conf *config.Config) (*TcpChecker, error) {
+	var c = new(TcpChecker)
+	c.conf = conf
+
+	if c.conf.TcpAddress == "" {
+		return nil, errors.New("tcp-address needs to be set when using the tcp checker")
+	}
+
+	return c, nil
+}
+
+func (c *TcpChecker) Check() error {
+	c.connected = false
+	conn, err := net.DialTimeout("tcp", c.conf.TcpAddress, time.Duration(c.conf.TcpTimeout)*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	c.connected = true
+
+	log.Debug("The tcp health check connected to: ", c.conf.TcpAddress)
+
+	return nil
+}
+
+func (c *TcpChecker) CompareExpected() bool {
+	//being able to connect is all we expect.
+	return c.connected
+}
+
+func (c *TcpChecker) IsHealthy() (bool, error) {
+	err := c.Check()
+	if err != nil {
+		return false, err
+	}
+	return c.CompareExpected(), nil
+}
@@ -0,0 +1,64 @@
+package checker
+
+import (
+	"fmt"
+
+	"github.com/cybertec-postgresql/yaim/config"
+)
+
+// Hysteresis smoothes the results of any checker, similar to the rise and fall settings of HAProxy.
+// The node only becomes healthy after rise consecutive successful checks
+// and only becomes unhealthy after fall consecutive failed checks.
+// Initially, the node is considered to be unhealthy.
+type Hysteresis struct {
+	rise      int
+	fall      int
+	healthy   bool
+	successes int
+	failures  int
+}
+
+func NewHysteresis(conf *config.Config) *Hysteresis {
+	var h = new(Hysteresis)
+	h.Reconfigure(conf)
+	return h
+}
+
+// Reconfigure applies new rise and fall settings, the current state and the counted checks are kept.
+func (h *Hysteresis) Reconfigure(conf *config.Config) {
+	h.rise = conf.Rise
+	if h.rise < 1 {
+		h.rise = 1
+	}
+	h.fall = conf.Fall
+	if h.fall < 1 {
+		h.fall = 1
+	}
+}
+
+// Update takes the result of a single check and returns the resulting health state.
+func (h *Hysteresis) Update(result bool) bool {
+	if result {
+		h.successes++
+		h.failures = 0
+		if !h.healthy && h.successes >= h.rise {
+			h.healthy = true
+		}
+	} else {
+		h.failures++
+		h.successes = 0
+		if h.healthy && h.failures >= h.fall {
+			h.healthy = false
+		}
+	}
+	return h.healthy
+}
+
+// State returns the current health state and the number of consecutive successful and failed checks.
+func (h *Hysteresis) State() (healthy bool, successes int, failures int) {
+	return h.healthy, h.successes, h.failures
+}
+
+func (h *Hysteresis) String() string {
+	return fmt.Sprintf("healthy: %t, successes: %d (rise: %d), failures: %d (fall: %d)", h.healthy, h.successes, h.rise, h.failures, h.fall)
+}
@@ -0,0 +1,72 @@
+package checker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cybertec-postgresql/yaim/config"
+)
+
+func TestHysteresis(t *testing.T) {
+	tests := []struct {
+		name    string
+		rise    int
+		fall    int
+		results []bool
+		want    []bool
+	}{
+		{
+			name:    "rise and fall of 1 follow every check",
+			rise:    1,
+			fall:    1,
+			results: []bool{true, false, true, true, false},
+			want:    []bool{true, false, true, true, false},
+		},
+		{
+			name:    "unset rise and fall count as 1",
+			results: []bool{true, false},
+			want:    []bool{true, false},
+		},
+		{
+			name:    "healthy after rise consecutive successful checks",
+			rise:    3,
+			fall:    1,
+			results: []bool{true, true, false, true, true, true},
+			want:    []bool{false, false, false, false, false, true},
+		},
+		{
+			name:    "unhealthy after fall consecutive failed checks",
+			rise:    1,
+			fall:    2,
+			results: []bool{true, false, true, false, false, true},
+			want:    []bool{true, true, true, true, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHysteresis(&config.Config{Rise: tt.rise, Fall: tt.fall})
+			var got []bool
+			for _, result := range tt.results {
+				got = append(got, h.Update(result))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got states %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHysteresisReconfigureKeepsState(t *testing.T) {
+	h := NewHysteresis(&config.Config{Rise: 3, Fall: 3})
+	h.Update(true)
+	h.Update(true)
+
+	h.Reconfigure(&config.Config{Rise: 2, Fall: 3})
+
+	if healthy, successes, failures := h.State(); healthy || successes != 2 || failures != 0 {
+		t.Errorf("state changed by reconfiguring: %s", h)
+	}
+	if !h.Update(true) {
+		t.Errorf("not healthy after the third successful check: %s", h)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+// yaimctl:	manage the pool of ip addresses and inspect the nodes of a yaim cluster.
+//
+// It reads the same configuration file, flags and env variables as yaim,
+// so it operates on the same DCS, namespace and cluster.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/cybertec-postgresql/yaim/config"
+	"github.com/cybertec-postgresql/yaim/dcs"
+)
+
+var (
+	// yaimctl version definition
+	version string = "0.0.1"
+)
+
+const usage = `Usage: yaimctl [--config <file>] <command> [<args>]
+
+Commands:
+  list                  list all ip addresses in the pool, the nodes holding them and the remaining TTL of their marks
+  nodes                 list all nodes advertising their healthiness
+  add <ip> [<spec>]     add an ip address to the pool, optionally with a spec, e.g. '{"interface": "eth1", "prefix": 24}'
+  remove <ip>           remove an ip address from the pool
+  spec <ip> [<spec>]    set the spec of an ip address in the pool, or remove it if none is given
+  unmark <ip>           remove the mark of an ip address, no matter which node holds it
+  drain [<node>]        put a node into maintenance, so it hands over all of its ip addresses (defaults to nodename)
+  resume [<node>]       take a node out of maintenance (defaults to nodename)
+
+Flags:
+`
+
+func main() {
+	pflag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		pflag.PrintDefaults()
+	}
+
+	conf, err := config.NewAdminConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error while loading configuration")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if showVersion, _ := pflag.CommandLine.GetBool("version"); showVersion {
+		fmt.Printf("version: %s\n", version)
+		return
+	}
+
+	args := pflag.Args()
+	if len(args) == 0 {
+		pflag.Usage()
+		os.Exit(2)
+	}
+
+	admin, err := dcs.NewAdmin(config.NewShared(conf))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error while initiating DCS connector")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = run(conf, admin, args[0], args[1:])
+	if err == errUsage {
+		pflag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("invalid usage")
+
+func run(conf *config.Config, admin dcs.Admin, command string, args []string) error {
+	switch command {
+	case "list":
+		if len(args) != 0 {
+			return errUsage
+		}
+		return list(admin)
+	case "nodes":
+		if len(args) != 0 {
+			return errUsage
+		}
+		return nodes(admin)
+	case "add":
+		if len(args) < 1 || len(args) > 2 {
+			return errUsage
+		}
+		spec := ""
+		if len(args) == 2 {
+			spec = args[1]
+			// don't add the address if it would be registered with the global settings instead.
+			if _, err := config.ParseIPSpec(spec); err != nil {
+				return fmt.Errorf("invalid spec: %w", err)
+			}
+		}
+		err := admin.AddIPToPool(args[0], spec)
+		if err != nil {
+			return err
+		}
+		fmt.Println("added ip address to the pool:", args[0])
+	case "remove":
+		if len(args) != 1 {
+			return errUsage
+		}
+		err := admin.RemoveIPFromPool(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println("removed ip address from the pool:", args[0])
+	case "spec":
+		if len(args) < 1 || len(args) > 2 {
+			return errUsage
+		}
+		spec := ""
+		if len(args) == 2 {
+			spec = args[1]
+			if _, err := config.ParseIPSpec(spec); err != nil {
+				return fmt.Errorf("invalid spec: %w", err)
+			}
+		}
+		err := admin.SetIPSpec(args[0], spec)
+		if err != nil {
+			return err
+		}
+		if spec == "" {
+			fmt.Println("removed spec of ip address:", args[0])
+		} else {
+			fmt.Println("set spec of ip address:", args[0])
+		}
+	case "unmark":
+		if len(args) != 1 {
+			return errUsage
+		}
+		err := admin.ForceUnMarkIP(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println("removed mark of ip address:", args[0])
+	case "drain", "resume":
+		if len(args) > 1 {
+			return errUsage
+		}
+		node := conf.Nodename
+		if len(args) == 1 {
+			node = args[0]
+		}
+		err := admin.SetMaintenance(node, command == "drain")
+		if err != nil {
+			return err
+		}
+		if command == "drain" {
+			fmt.Println("node is in maintenance:", node)
+		} else {
+			fmt.Println("node is no longer in maintenance:", node)
+		}
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func formatTTL(ttl time.Duration) string {
+	if ttl <= 0 {
+		return "-"
+	}
+	return ttl.Round(time.Millisecond).String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func list(admin dcs.Admin) error {
+	state, err := admin.GetPoolState()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tHOLDER\tTTL\tCLAIM\tSPEC")
+	for _, ip := range state.IPs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", ip.IP, orDash(ip.Holder), formatTTL(ip.TTL), orDash(ip.Claim), orDash(ip.Spec))
+	}
+	return w.Flush()
+}
+
+func nodes(admin dcs.Admin) error {
+	state, err := admin.GetPoolState()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tTTL\tMAINTENANCE\tWEIGHT\tMAX-IPS\tTAGS")
+	advertised := make(map[string]bool)
+	for _, node := range state.Nodes {
+		advertised[node.Name] = true
+		info := node.Info()
+		maxIPs := "-"
+		if info.MaxIPs > 0 {
+			maxIPs = fmt.Sprint(info.MaxIPs)
+		}
+		var tags []string
+		for k, v := range info.Tags {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+		fmt.Fprintf(w, "%s\t%s\t%t\t%d\t%s\t%s\n", node.Name, formatTTL(node.TTL), state.InMaintenance(node.Name), info.Weight, maxIPs, orDash(strings.Join(tags, ",")))
+	}
+	//nodes in maintenance that are not running.
+	for _, node := range state.Maintenance {
+		if !advertised[node] {
+			fmt.Fprintf(w, "%s\t-\ttrue\t-\t-\t-\n", node)
+		}
+	}
+	return w.Flush()
+}
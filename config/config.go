@@ -1,28 +1,67 @@
 package config
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 var versionString = "0.0.1"
 
+// Shared holds the configuration in effect, for components that keep running while it is reloaded.
+// The configuration is replaced as a whole, so it can be read from any goroutine without further locking.
+type Shared struct {
+	current atomic.Value
+}
+
+func NewShared(conf *Config) *Shared {
+	s := &Shared{}
+	s.Set(conf)
+	return s
+}
+
+// Get returns the configuration in effect, which must not be modified.
+// Components call it for each operation, so they use the new settings after a reload.
+func (s *Shared) Get() *Config {
+	return s.current.Load().(*Config)
+}
+
+func (s *Shared) Set(conf *Config) {
+	s.current.Store(conf)
+}
+
+// BgpPeer is a BGP neighbor that the addresses of this node are announced to.
+type BgpPeer struct {
+	Address string `mapstructure:"address"`
+	Asn     int    `mapstructure:"asn"`  // defaults to bgp-asn, i.e. iBGP
+	Port    int    `mapstructure:"port"` // defaults to 179
+}
+
 // Config represents the configuration of the VIP manager
 type Config struct {
 	Mask  int    `mapstructure:"netmask"`
+	Mask6 int    `mapstructure:"netmask6"` // used for IPv6 addresses
 	Iface string `mapstructure:"interface"`
 	Label string `mapstructure:"label"`
 
 	HostingType string `mapstructure:"manager-type"`
 
+	ArpProbe     bool `mapstructure:"arp-probe"`      // check if an address is in use by another host before adding it
+	ArpProbeNum  int  `mapstructure:"arp-probe-num"`  // number of probes to send
+	ArpProbeWait int  `mapstructure:"arp-probe-wait"` //milliseconds to wait for replies after each probe
+
 	Nodename string `mapstructure:"nodename"` //hostname to trigger on. usually the name of the host where this vip-manager runs.
 
 	DcsType      string   `mapstructure:"dcs-type"`
@@ -32,8 +71,17 @@ type Config struct {
 
 	DcsClusterName string `mapstructure:"dcs-clustername"`
 
+	AllocationStrategy string `mapstructure:"allocation-strategy"` // how to distribute the IP addresses among the nodes
+	Weight             int    `mapstructure:"weight"`              // share of IP addresses of this node, relative to the other nodes
+	MaxIPs             int    `mapstructure:"max-ips"`             // 0 means no limit
+
+	Tags map[string]string `mapstructure:"tags"` // advertised for this node, matched against the affinity of IP addresses
+
 	CheckerType string `mapstructure:"checker-type"`
 
+	CompositeMode string                   `mapstructure:"composite-mode"` // all, any or at-least-N
+	Checkers      []map[string]interface{} `mapstructure:"checkers"`       // settings of each checker combined by the composite checker
+
 	HttpUrl                      string `mapstructure:"http-url"`
 	HttpUser                     string `mapstructure:"http-user"`
 	HttpPassword                 string `mapstructure:"http-password"`
@@ -51,7 +99,20 @@ type Config struct {
 	PostgresCAFile           string `mapstructure:"postgres-ca-file"`
 	PostgresCertFile         string `mapstructure:"postgres-cert-file"`
 	PostgresKeyFile          string `mapstructure:"postgres-key-file"`
-	PostgresExpectedResponse string `mapstructure:"postgres-exprected-response"`
+	PostgresExpectedResponse string `mapstructure:"postgres-expected-response"`
+	PostgresConnectTimeout   int    `mapstructure:"postgres-connect-timeout"`   //milliseconds
+	PostgresStatementTimeout int    `mapstructure:"postgres-statement-timeout"` //milliseconds
+
+	TcpAddress string `mapstructure:"tcp-address"`
+	TcpTimeout int    `mapstructure:"tcp-timeout"` //milliseconds
+
+	ShellCommand                string   `mapstructure:"shell-command"`
+	ShellArgs                   []string `mapstructure:"shell-args"`
+	ShellEnv                    []string `mapstructure:"shell-env"`     // KEY=value, added to the environment of yaim
+	ShellTimeout                int      `mapstructure:"shell-timeout"` //milliseconds
+	ShellExpectedExitCode       int      `mapstructure:"shell-expected-exit-code"`
+	ShellExpectedOutput         string   `mapstructure:"shell-expected-output"`
+	ShellExpectedOutputContains string   `mapstructure:"shell-expected-output-contains"`
 
 	EtcdUser     string `mapstructure:"etcd-user"`
 	EtcdPassword string `mapstructure:"etcd-password"`
@@ -61,14 +122,47 @@ type Config struct {
 
 	ConsulToken string `mapstructure:"consul-token"`
 
+	HetznerApiUrl      string `mapstructure:"hetzner-api-url"`
+	HetznerToken       string `mapstructure:"hetzner-token"`
+	HetznerTokenFile   string `mapstructure:"hetzner-token-file"` // used if hetzner-token is not set
+	HetznerServerID    int    `mapstructure:"hetzner-server-id"`  // retrieved from the metadata service if not set
+	HetznerMetadataUrl string `mapstructure:"hetzner-metadata-url"`
+
+	AwsRegion             string `mapstructure:"aws-region"`               // retrieved from the instance metadata if not set
+	AwsEndpoint           string `mapstructure:"aws-endpoint"`             // instead of the EC2 endpoint of the region
+	AwsNetworkInterfaceID string `mapstructure:"aws-network-interface-id"` // retrieved from the instance metadata if not set
+	AwsAccessKeyID        string `mapstructure:"aws-access-key-id"`        // instead of the credentials from the environment or the instance profile
+	AwsSecretAccessKey    string `mapstructure:"aws-secret-access-key"`
+
+	BgpAsn              int       `mapstructure:"bgp-asn"`
+	BgpRouterID         string    `mapstructure:"bgp-router-id"`
+	BgpListenPort       int       `mapstructure:"bgp-listen-port"` // -1 means only connecting to the peers
+	BgpPeers            []BgpPeer `mapstructure:"bgp-peers"`
+	BgpPassword         string    `mapstructure:"bgp-password"`          // TCP MD5 password for all peers
+	BgpCommunities      []string  `mapstructure:"bgp-communities"`       // attached to all announced routes, e.g. 65000:100
+	BgpNextHop          string    `mapstructure:"bgp-next-hop"`          // for IPv4 routes, defaults to the local address of each session
+	BgpNextHop6         string    `mapstructure:"bgp-next-hop6"`         // for IPv6 routes, defaults to the local address of each session
+	BgpConfigureAddress bool      `mapstructure:"bgp-configure-address"` // register the announced addresses on the interface as well, e.g. on lo
+
 	TTL int `mapstructure:"ttl"`
 
-	Interval int `mapstructure:"interval"` //milliseconds
+	Fencing            bool    `mapstructure:"fencing"`
+	FencingTTLFraction float64 `mapstructure:"fencing-ttl-fraction"` // drop all addresses if the DCS can't be refreshed within this fraction of the TTL
+
+	Interval      int `mapstructure:"interval"`       //milliseconds
+	WatchDebounce int `mapstructure:"watch-debounce"` //milliseconds to wait for further changes in the DCS before reacting to them
 
 	RetryAfter int `mapstructure:"retry-after"` //milliseconds
 	RetryNum   int `mapstructure:"retry-num"`
 
+	Rise int `mapstructure:"rise"` // consecutive successful checks needed to become healthy
+	Fall int `mapstructure:"fall"` // consecutive failed checks needed to become unhealthy
+
 	LogLevel string `mapstructure:"log-level"` // Trace, Debug, Info, Warning, Error, Fatal and Panic
+
+	ApiAddress string `mapstructure:"api-address"` // e.g. "127.0.0.1:9106" or "unix:/run/yaim/yaim.sock", serves the status and control API if set
+
+	MetricsAddress string `mapstructure:"metrics-address"` // e.g. ":9105", exports Prometheus metrics under /metrics if set
 }
 
 func defineFlags() {
@@ -81,12 +175,42 @@ func defineFlags() {
 
 func setDefaults() {
 	defaults := map[string]string{
-		"dcs-type":    "etcd",
-		"interval":    "1000",
-		"hostingtype": "basic",
-		"retry-num":   "3",
-		"retry-after": "250",
-		"log-level":   "Info",
+		"dcs-type":     "etcd",
+		"netmask6":     "128",
+		"interval":     "1000",
+		"manager-type": "basic",
+		"retry-num":    "3",
+		"retry-after":  "250",
+		"rise":         "1",
+		"fall":         "1",
+
+		"arp-probe":      "false",
+		"arp-probe-num":  "3",
+		"arp-probe-wait": "200",
+
+		"fencing":              "false",
+		"fencing-ttl-fraction": "0.5",
+		"log-level":            "Info",
+
+		"postgres-connect-timeout":   "1000",
+		"postgres-statement-timeout": "1000",
+
+		"shell-timeout": "1000",
+		"tcp-timeout":   "1000",
+
+		"composite-mode": "all",
+
+		"allocation-strategy": "balanced",
+		"weight":              "1",
+		"max-ips":             "0",
+
+		"watch-debounce": "50",
+
+		"hetzner-api-url":      "https://api.hetzner.cloud/v1",
+		"hetzner-metadata-url": "http://169.254.169.254/hetzner/v1/metadata",
+
+		"bgp-listen-port":       "-1",
+		"bgp-configure-address": "true",
 	}
 
 	for k, v := range defaults {
@@ -104,13 +228,7 @@ func checkSetting(name string) bool {
 	return true
 }
 
-func checkMandatory() error {
-	mandatory := []string{
-		"netmask",
-		"interface",
-		"nodename",
-		"dcs-endpoints",
-	}
+func checkMandatory(mandatory []string) error {
 	success := true
 	for _, v := range mandatory {
 		success = checkSetting(v) && success
@@ -137,6 +255,10 @@ func checkImpliedMandatory() error {
 		"etcd-user":     "etcd-password",
 		"etcd-key-file": "etcd-cert-file",
 		"etcd-ca-file":  "etcd-cert-file",
+
+		"aws-secret-access-key": "aws-access-key-id",
+
+		"postgres-key-file": "postgres-cert-file",
 	}
 	success := true
 	for k, v := range mandatory {
@@ -148,20 +270,91 @@ func checkImpliedMandatory() error {
 	return nil
 }
 
-func printSettings() {
-	s := []string{}
+func isSecret(k string) bool {
+	switch k {
+	case "etcd-password":
+		fallthrough
+	case "postgres-password":
+		fallthrough
+	case "http-password":
+		fallthrough
+	case "consul-token":
+		fallthrough
+	case "hetzner-token":
+		fallthrough
+	case "aws-secret-access-key":
+		fallthrough
+	case "bgp-password":
+		return true
+	}
+	return false
+}
 
-	for k, v := range viper.AllSettings() {
-		if v != "" {
-			switch k {
-			case "etcd-password":
-				fallthrough
-			case "consul-token":
-				s = append(s, fmt.Sprintf("\t%s : *****\n", k))
-			default:
-				s = append(s, fmt.Sprintf("\t%s : %v\n", k, v))
+// the settings of the checkers combined by the composite checker may contain secrets as well.
+// They are copied, so the settings of the running checkers are left alone.
+func maskCheckers(v interface{}) interface{} {
+	var checkers []interface{}
+	switch c := v.(type) {
+	case []map[string]interface{}:
+		for _, settings := range c {
+			checkers = append(checkers, settings)
+		}
+	case []interface{}:
+		checkers = c
+	default:
+		return v
+	}
+	masked := []interface{}{}
+	for _, c := range checkers {
+		settings := map[string]interface{}{}
+		err := mapstructure.Decode(c, &settings)
+		if err != nil {
+			masked = append(masked, c)
+			continue
+		}
+		for k := range settings {
+			if isSecret(k) {
+				settings[k] = "*****"
 			}
 		}
+		masked = append(masked, settings)
+	}
+	return masked
+}
+
+// MaskedSettings returns all settings of conf that are set, with secrets masked.
+func MaskedSettings(conf *Config) map[string]interface{} {
+	all := make(map[string]interface{})
+	err := mapstructure.Decode(conf, &all)
+	if err != nil {
+		log.Error("unable to convert config struct into settings:")
+		log.Error(err)
+	}
+	settings := make(map[string]interface{})
+	for k, v := range all {
+		if v == "" {
+			continue
+		}
+		if rv := reflect.ValueOf(v); (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Map) && rv.Len() == 0 {
+			continue
+		}
+		switch {
+		case isSecret(k):
+			settings[k] = "*****"
+		case k == "checkers":
+			settings[k] = maskCheckers(v)
+		default:
+			settings[k] = v
+		}
+	}
+	return settings
+}
+
+func printSettings(conf *Config) {
+	s := []string{}
+
+	for k, v := range MaskedSettings(conf) {
+		s = append(s, fmt.Sprintf("\t%s : %v\n", k, v))
 	}
 
 	sort.Strings(s)
@@ -171,12 +364,196 @@ func printSettings() {
 	}
 }
 
+// CheckerConfigs returns one Config instance for each of the checkers combined by the composite checker.
+// Settings given for a checker override the ones given for yaim itself.
+func (c *Config) CheckerConfigs() ([]*Config, error) {
+	var confs []*Config
+	for i, settings := range c.Checkers {
+		conf := *c
+		conf.Checkers = nil
+		// the settings are copied, as they are shared with the running configuration.
+		values := make(map[string]interface{}, len(settings))
+		for k, v := range settings {
+			values[k] = v
+		}
+		for old, name := range renamed {
+			if _, ok := values[name]; !ok && values[old] != nil {
+				log.Warningf("%s of checker %d is deprecated, use %s instead.", old, i+1, name)
+				values[name] = values[old]
+			}
+		}
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			Result:           &conf,
+			WeaklyTypedInput: true,
+			DecodeHook:       mapstructure.StringToSliceHookFunc(","),
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = decoder.Decode(values)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode settings of checker %d: %w", i+1, err)
+		}
+		confs = append(confs, &conf)
+	}
+	return confs, nil
+}
+
+// RequestTimeout returns how long a single request to the DCS or to the API of a cloud provider may take.
+// Requests that take longer than the TTL are pointless, as the marks would have expired by then anyway.
+func (c *Config) RequestTimeout() time.Duration {
+	return time.Duration(c.TTL) * time.Millisecond
+}
+
+// RequestContext returns a context for a single request, which is canceled after RequestTimeout.
+func (c *Config) RequestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.RequestTimeout())
+}
+
 // NewConfig returns a new Config instance
 func NewConfig() (*Config, error) {
-	var err error
+	conf, err := load(mandatory)
+	if err != nil {
+		return nil, err
+	}
+
+	printSettings(conf)
+
+	return conf, nil
+}
+
+// NewAdminConfig returns a new Config instance for tools that only need to access the DCS, like yaimctl.
+// The config file, flags and env variables are the same as for yaim itself,
+// remaining command line arguments can be retrieved with pflag.Args().
+func NewAdminConfig() (*Config, error) {
+	return load([]string{
+		"dcs-endpoints",
+	})
+}
+
+// mandatory settings of yaim itself, as opposed to yaimctl.
+var mandatory = []string{
+	"netmask",
+	"interface",
+	"nodename",
+	"dcs-endpoints",
+}
+
+// these settings are used to find the addresses and marks of this node, or can't be changed at runtime for other reasons.
+var immutable = []string{
+	"netmask",
+	"netmask6",
+	"interface",
+	"label",
+	"manager-type",
+	"nodename",
+	// leases and sessions keep the TTL they have been created with, the fencing deadline needs to match it.
+	"ttl",
+	"dcs-type",
+	"dcs-endpoints",
+	"dcs-namespace",
+	"dcs-clustername",
+	"etcd-user",
+	"etcd-password",
+	"etcd-ca-file",
+	"etcd-cert-file",
+	"etcd-key-file",
+	"consul-token",
+	"hetzner-api-url",
+	"hetzner-token",
+	"hetzner-token-file",
+	"hetzner-server-id",
+	"hetzner-metadata-url",
+	"aws-region",
+	"aws-endpoint",
+	"aws-network-interface-id",
+	"aws-access-key-id",
+	"aws-secret-access-key",
+	"bgp-asn",
+	"bgp-router-id",
+	"bgp-listen-port",
+	"bgp-peers",
+	"bgp-password",
+	"bgp-configure-address",
+	"api-address",
+	"metrics-address",
+}
+
+// Reload reads the config file, env variables and flags again, e.g. after SIGHUP.
+// An error is returned if the new configuration is invalid or if it changes any settings that can't be changed at runtime,
+// in that case the current configuration stays in effect.
+func Reload(current *Config) (*Config, error) {
+	viper.Reset()
+	conf, err := read(mandatory)
+	if err == nil {
+		err = checkImmutable(current, conf)
+	}
+	if err != nil {
+		if logLevel, levelErr := log.ParseLevel(current.LogLevel); levelErr == nil {
+			log.SetLevel(logLevel)
+		}
+		return nil, err
+	}
 
+	printSettings(conf)
+
+	return conf, nil
+}
+
+func checkImmutable(current *Config, conf *Config) error {
+	before := make(map[string]interface{})
+	after := make(map[string]interface{})
+	err := mapstructure.Decode(current, &before)
+	if err != nil {
+		return err
+	}
+	err = mapstructure.Decode(conf, &after)
+	if err != nil {
+		return err
+	}
+	success := true
+	for _, k := range immutable {
+		if reflect.DeepEqual(before[k], after[k]) {
+			continue
+		}
+		if isSecret(k) {
+			log.Printf("Setting %s can't be changed while yaim is running, restart yaim to change it", k)
+		} else {
+			log.Printf("Setting %s can't be changed while yaim is running, restart yaim to change it from %v to %v", k, before[k], after[k])
+		}
+		success = false
+	}
+	if !success {
+		return errors.New("one or more settings can't be changed while yaim is running")
+	}
+	return nil
+}
+
+// renamed maps the old names of settings to their new ones, the old names are still accepted.
+var renamed = map[string]string{
+	"postgres-exprected-response": "postgres-expected-response",
+}
+
+// applyRenamed sets the new names of renamed settings that are only given by their old name.
+func applyRenamed() {
+	for old, name := range renamed {
+		if viper.IsSet(old) && !viper.IsSet(name) {
+			log.Warningf("%s is deprecated, use %s instead.", old, name)
+			viper.Set(name, viper.Get(old))
+		}
+	}
+}
+
+func load(mandatory []string) (*Config, error) {
 	defineFlags()
 	pflag.Parse()
+	return read(mandatory)
+}
+
+// read can be called again after viper.Reset(), the flags only need to be parsed once.
+func read(mandatory []string) (*Config, error) {
+	var err error
+
 	// import pflags into viper
 	_ = viper.BindPFlags(pflag.CommandLine)
 
@@ -208,6 +585,7 @@ func NewConfig() (*Config, error) {
 		log.Printf("Using config from file: %s\n", viper.ConfigFileUsed())
 	}
 
+	applyRenamed()
 	setDefaults()
 
 	logLevel, err := log.ParseLevel(viper.GetString("log-level"))
@@ -230,7 +608,7 @@ func NewConfig() (*Config, error) {
 		switch viper.GetString("dcs-type") {
 		case "consul":
 			viper.Set("dcs-endpoints", []string{"http://127.0.0.1:8500"})
-		case "etcd":
+		case "etcd", "etcd3":
 			viper.Set("dcs-endpoints", []string{"http://127.0.0.1:2379"})
 		}
 	}
@@ -246,7 +624,7 @@ func NewConfig() (*Config, error) {
 		}
 	}
 
-	if err = checkMandatory(); err != nil {
+	if err = checkMandatory(mandatory); err != nil {
 		return nil, err
 	}
 
@@ -257,10 +635,8 @@ func NewConfig() (*Config, error) {
 	conf := &Config{}
 	err = viper.Unmarshal(conf)
 	if err != nil {
-		log.Fatalf("unable to decode viper config into config struct, %v", err)
+		return nil, fmt.Errorf("unable to decode viper config into config struct, %w", err)
 	}
 
-	printSettings()
-
 	return conf, nil
 }
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestMaskedSettingsMasksCheckers(t *testing.T) {
+	conf := &Config{
+		CheckerType:  "composite",
+		EtcdPassword: "etcd-secret",
+		Checkers: []map[string]interface{}{
+			{"checker-type": "postgres", "postgres-password": "pg-secret"},
+			{"checker-type": "tcp", "tcp-address": "127.0.0.1:5432"},
+		},
+	}
+
+	settings := MaskedSettings(conf)
+
+	if settings["etcd-password"] != "*****" {
+		t.Errorf("etcd-password not masked: %v", settings["etcd-password"])
+	}
+	want := []interface{}{
+		map[string]interface{}{"checker-type": "postgres", "postgres-password": "*****"},
+		map[string]interface{}{"checker-type": "tcp", "tcp-address": "127.0.0.1:5432"},
+	}
+	if !reflect.DeepEqual(settings["checkers"], want) {
+		t.Errorf("checkers not masked: %v", settings["checkers"])
+	}
+	if conf.Checkers[0]["postgres-password"] != "pg-secret" {
+		t.Errorf("settings of the running checker have been changed: %v", conf.Checkers[0])
+	}
+}
+
+func TestMaskCheckersDecodedFromViper(t *testing.T) {
+	checkers := []interface{}{
+		map[interface{}]interface{}{"checker-type": "http", "http-password": "plain", "postgres-password": "pg-secret"},
+	}
+
+	masked := maskCheckers(checkers).([]interface{})
+
+	settings := masked[0].(map[string]interface{})
+	for _, k := range []string{"http-password", "postgres-password"} {
+		if settings[k] != "*****" {
+			t.Errorf("%s not masked: %v", k, settings[k])
+		}
+	}
+}
+
+func TestRenamedSettings(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("postgres-exprected-response", "t")
+
+	applyRenamed()
+
+	if got := viper.GetString("postgres-expected-response"); got != "t" {
+		t.Errorf("postgres-exprected-response not applied: %q", got)
+	}
+
+	viper.Set("postgres-expected-response", "f")
+	applyRenamed()
+
+	if got := viper.GetString("postgres-expected-response"); got != "f" {
+		t.Errorf("postgres-expected-response overridden by its old name: %q", got)
+	}
+}
+
+func TestCheckerConfigsRenamedSettings(t *testing.T) {
+	conf := &Config{
+		CheckerType: "composite",
+		Checkers: []map[string]interface{}{
+			{"checker-type": "postgres", "postgres-exprected-response": "t"},
+			{"checker-type": "postgres", "postgres-exprected-response": "t", "postgres-expected-response": "f"},
+		},
+	}
+
+	confs, err := conf.CheckerConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, c := range confs {
+		got = append(got, c.PostgresExpectedResponse)
+	}
+	if want := []string{"t", "f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got expected responses %v, want %v", got, want)
+	}
+	if _, ok := conf.Checkers[0]["postgres-expected-response"]; ok {
+		t.Errorf("settings of the running checker have been changed: %v", conf.Checkers[0])
+	}
+}
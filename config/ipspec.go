@@ -0,0 +1,38 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// IPSpec holds the settings for a single IP address in the pool.
+// It is stored in the DCS next to the marks of the address, e.g. ips/10.0.0.5/spec.
+// Settings that are left out fall back to the global configuration.
+type IPSpec struct {
+	Prefix    int    `json:"prefix,omitempty"`     // length of the network prefix, instead of netmask or netmask6
+	Interface string `json:"interface,omitempty"`  // instead of interface
+	Label     string `json:"label,omitempty"`      // appended to the label of IPv4 addresses
+	Garp      *bool  `json:"garp,omitempty"`       // send gratuitous ARP or unsolicited neighbor advertisements after adding the address, defaults to true
+	ElasticIP string `json:"elastic-ip,omitempty"` // with manager-type aws, the Elastic IP associated with this private address
+
+	Affinity     map[string]string `json:"affinity,omitempty"`      // tags of the nodes the address prefers, e.g. {"zone": "a"}, the tag "name" matches the nodename
+	AntiAffinity string            `json:"anti-affinity,omitempty"` // addresses in the same group are never put on the same node
+}
+
+// ParseIPSpec parses and validates the spec of an IP address as it is stored in the DCS.
+func ParseIPSpec(value string) (IPSpec, error) {
+	var spec IPSpec
+	err := json.Unmarshal([]byte(value), &spec)
+	if err != nil {
+		return spec, err
+	}
+	if spec.Prefix < 0 || spec.Prefix > 128 {
+		return spec, fmt.Errorf("invalid prefix length: %d", spec.Prefix)
+	}
+	return spec, nil
+}
+
+// SendGarp returns whether the address should be announced after it has been added.
+func (s IPSpec) SendGarp() bool {
+	return s.Garp == nil || *s.Garp
+}
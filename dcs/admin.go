@@ -0,0 +1,39 @@
+package dcs
+
+import (
+	"github.com/cybertec-postgresql/yaim/config"
+)
+
+// Admin offers the operations needed to manage the pool of a yaim cluster, e.g. by yaimctl.
+type Admin interface {
+	Dcs
+	// AddIPToPool adds an IP address to the pool along with its spec, if one is given.
+	// Nodes never see the address without its spec, so they don't register it with the global settings first.
+	AddIPToPool(ip string, spec string) error
+	RemoveIPFromPool(ip string) error
+	// SetIPSpec stores the spec of an IP address that is already in the pool, an empty spec removes it.
+	SetIPSpec(ip string, spec string) error
+	// ForceUnMarkIP removes the mark of an IP address, no matter which node holds it.
+	ForceUnMarkIP(ip string) error
+	// SetMaintenance puts a node into maintenance or takes it out again.
+	SetMaintenance(node string, enabled bool) error
+}
+
+// NewAdmin returns a new Admin instance depending on the configuration
+func NewAdmin(conf *config.Shared) (Admin, error) {
+	var a Admin
+	var err error
+
+	switch conf.Get().DcsType {
+	case "etcd":
+		a, err = NewEtcdDcs(conf)
+	case "etcd3":
+		a, err = NewEtcd3Dcs(conf)
+	case "consul":
+		a, err = NewConsulDcs(conf)
+	default:
+		err = ErrUnsupporteDCSType
+	}
+
+	return a, err
+}
@@ -1,7 +1,10 @@
 package dcs
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
 
 	"github.com/cybertec-postgresql/yaim/config"
 )
@@ -11,31 +14,45 @@ var ErrUnsupporteDCSType = errors.New("given endpoint type not supported")
 
 // LeaderChecker is the interface for checking leadership
 type Dcs interface {
-	AdvertiseInDCS()
-	CheckIpInDCS(ip string) bool
-	MarkIpInDCS(ip string) (success bool)
-	RefreshMarkIpInDCS(ip string)
-	UnMarkIpInDCS(ip string)
+	AdvertiseInDCS() error
+	UnAdvertiseInDCS()
+	// CheckIpInDCS, MarkIpInDCS and ClaimIpInDCS return false without an error if another node holds the IP,
+	// or if it isn't part of the pool. Errors are only returned if the DCS failed to process the request.
+	CheckIpInDCS(ip string) (marked bool, err error)
+	MarkIpInDCS(ip string) (success bool, err error)
+	RefreshMarkIpInDCS(ip string) error
+	UnMarkIpInDCS(ip string) error
 	UnMarkAllIPs(ips []string)
-	GetNumberAdvertisments() (num int, err error)
 	GetIPs() (IPs, ownMarkedIPs, unmarkedIPs []string, err error)
+	GetIPSpecs() (specs map[string]config.IPSpec, err error)
+	GetPoolState() (*PoolState, error)
+	// ClaimIpInDCS announces that this node is ready to take over an IP from a node in maintenance.
+	ClaimIpInDCS(ip string) (success bool, err error)
+	UnClaimIpInDCS(ip string) error
+	// Watch notifies about all changes of the keys of this cluster, until ctx is done.
+	// Notifications are coalesced, so a receiver that is busy will only see one of them.
+	// Refreshing a key without changing its value is not considered a change.
+	Watch(ctx context.Context) <-chan struct{}
 }
 
-// NewLeaderChecker returns a new LeaderChecker instance depending on the configuration
-func NewDcs(conf *config.Config) (Dcs, error) {
-	var d Dcs
-	var err error
-
-	switch conf.DcsType {
-	// case "postgres":
-	// 	c, err = NewPostgresChecker(con)
-	// case "shell":
-	// 	c, err = NewShellChecker(con)
-	case "etcd":
-		d, err = NewEtcdDcs(conf)
-	default:
-		err = ErrUnsupporteDCSType
+// NewDcs returns a new Dcs instance depending on the configuration, all of them offer the Admin operations as well.
+func NewDcs(conf *config.Shared) (Dcs, error) {
+	a, err := NewAdmin(conf)
+	if err != nil {
+		return nil, err
 	}
+	return a, nil
+}
 
-	return d, err
+// IP addresses are used as keys in the DCS, so they need to be given in their canonical form,
+// e.g. 2001:db8::1 instead of 2001:0DB8:0:0::1. Otherwise, they couldn't be matched with the addresses on the interface.
+func checkIPKey(key string) error {
+	ip := net.ParseIP(key)
+	if ip == nil {
+		return errors.New("not a valid IP address: " + key)
+	}
+	if ip.String() != key {
+		return fmt.Errorf("IP address %s is not in its canonical form, use %s instead", key, ip)
+	}
+	return nil
 }
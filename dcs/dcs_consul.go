@@ -0,0 +1,683 @@
+package dcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/yaim/config"
+	"github.com/cybertec-postgresql/yaim/notify"
+	"github.com/hashicorp/consul/api"
+)
+
+// Consul refuses session TTLs below 10 seconds.
+const consulMinSessionTTL = 10 * time.Second
+
+// ConsulDcs uses a Consul session with a TTL.
+// The node advertisement and all "marked" keys of this node are acquired with that session,
+// so renewing the session refreshes all of them at once.
+// If the session is invalidated, Consul deletes all keys that were acquired with it.
+// Keys are owned by the node named in their value, keys of this node that are still held by a previous session,
+// e.g. after a restart, are moved to the current one.
+type ConsulDcs struct {
+	shared   *config.Shared
+	basepath string
+	cfg      *api.Config
+	cl       *api.Client
+	kv       *api.KV
+	session  string
+}
+
+func (d *ConsulDcs) conf() *config.Config {
+	return d.shared.Get()
+}
+
+func NewConsulDcs(conf *config.Shared) (*ConsulDcs, error) {
+	var err error
+	var d ConsulDcs
+
+	d.shared = conf
+	// keys in Consul must not start with a slash.
+	d.basepath = strings.TrimPrefix(d.conf().DcsNamespace+d.conf().DcsClusterName+"/", "/")
+
+	d.cfg = api.DefaultConfig()
+	if len(d.conf().DcsEndpoints) > 0 {
+		// the Consul client only supports a single address.
+		endpoint, err := url.Parse(d.conf().DcsEndpoints[0])
+		if err != nil {
+			return nil, err
+		}
+		if endpoint.Host != "" {
+			d.cfg.Address = endpoint.Host
+			d.cfg.Scheme = endpoint.Scheme
+		} else {
+			d.cfg.Address = d.conf().DcsEndpoints[0]
+		}
+		if len(d.conf().DcsEndpoints) > 1 {
+			log.Print("The Consul client only supports a single endpoint, using: ", d.conf().DcsEndpoints[0])
+		}
+	}
+	d.cfg.Token = d.conf().ConsulToken
+
+	d.cl, err = api.NewClient(d.cfg)
+	if err != nil {
+		log.Fatal("couldn't initialize consul client", err)
+	}
+	d.kv = d.cl.KV()
+
+	// there are no directories in Consul, so there is no k/v structure to be created here.
+	return &d, nil
+}
+
+func (d *ConsulDcs) context() (context.Context, context.CancelFunc) {
+	return d.conf().RequestContext()
+}
+
+func (d *ConsulDcs) queryOptions(ctx context.Context) *api.QueryOptions {
+	q := &api.QueryOptions{RequireConsistent: true}
+	return q.WithContext(ctx)
+}
+
+func (d *ConsulDcs) writeOptions(ctx context.Context) *api.WriteOptions {
+	w := &api.WriteOptions{}
+	return w.WithContext(ctx)
+}
+
+func (d *ConsulDcs) nodeKey() string {
+	return d.basepath + "nodes/" + d.conf().Nodename
+}
+
+func (d *ConsulDcs) ipKey(ip string) string {
+	return d.basepath + "ips/" + ip + "/"
+}
+
+func (d *ConsulDcs) markedKey(ip string) string {
+	return d.basepath + "ips/" + ip + "/marked"
+}
+
+func (d *ConsulDcs) specKey(ip string) string {
+	return d.basepath + "ips/" + ip + "/spec"
+}
+
+func (d *ConsulDcs) claimKey(ip string) string {
+	return d.basepath + "ips/" + ip + "/claim"
+}
+
+func (d *ConsulDcs) sessionTTL() time.Duration {
+	ttl := time.Duration(d.conf().TTL) * time.Millisecond
+	if ttl < consulMinSessionTTL {
+		log.Debug("Consul sessions need a TTL of at least ", consulMinSessionTTL, ", using that instead of ", ttl)
+		ttl = consulMinSessionTTL
+	}
+	return ttl
+}
+
+// renewSession refreshes the session of this node, or creates a new one if there is none or if it has been invalidated.
+// All keys acquired with an invalidated session are gone, so they will need to be recreated by the caller.
+func (d *ConsulDcs) renewSession() error {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	if d.session != "" {
+		entry, _, err := d.cl.Session().Renew(d.session, d.writeOptions(ctx))
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			log.Debug("Renewed session in consul: ", d.session)
+			return nil
+		}
+		log.Print("Session in consul has been invalidated: ", d.session)
+		d.session = ""
+	}
+
+	// The session is not bound to the health checks of any Consul agent, only the TTL matters.
+	// A lock delay of 0 would make Consul fall back to its default of 15s,
+	// so we specify a very short one to not slow down the failover any further.
+	id, _, err := d.cl.Session().CreateNoChecks(&api.SessionEntry{
+		Name:      "yaim-" + d.conf().Nodename,
+		TTL:       d.sessionTTL().String(),
+		Behavior:  api.SessionBehaviorDelete,
+		LockDelay: time.Millisecond,
+	}, d.writeOptions(ctx))
+	if err != nil {
+		return err
+	}
+	d.session = id
+	log.Print("Created new session in consul: ", d.session)
+	return nil
+}
+
+func (d *ConsulDcs) AdvertiseInDCS() error {
+	//renewing the session will also refresh all marks of this node.
+	err := d.renewSession()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := d.context()
+	defer cancel()
+	acquired, _, err := d.kv.Acquire(&api.KVPair{
+		Key:     d.nodeKey(),
+		Value:   []byte(advertisement(d.conf())),
+		Session: d.session,
+	}, d.writeOptions(ctx))
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		// the key might still be held by a previous session of this node.
+		pair, _, err := d.kv.Get(d.nodeKey(), d.queryOptions(ctx))
+		if err != nil {
+			return err
+		}
+		if pair == nil || pair.Session == "" {
+			return errors.New("failed to acquire key for this node in consul: " + d.nodeKey())
+		}
+		return d.adopt(ctx, d.nodeKey(), []byte(advertisement(d.conf())), pair.Session)
+	}
+	return nil
+}
+
+// isOwn returns true if the key is held by a session of this node, which doesn't need to be the current one.
+func (d *ConsulDcs) isOwn(p *api.KVPair) bool {
+	return p.Session != "" && string(p.Value) == d.conf().Nodename
+}
+
+// adopt moves a key of this node from a previous session to the current one.
+// Releasing and acquiring the key happen in the same transaction, so no other node can acquire it in between.
+func (d *ConsulDcs) adopt(ctx context.Context, key string, value []byte, session string) error {
+	if session == d.session {
+		return nil
+	}
+	if d.session == "" {
+		err := d.renewSession()
+		if err != nil {
+			return err
+		}
+	}
+	ok, resp, _, err := d.kv.Txn(api.KVTxnOps{
+		&api.KVTxnOp{Verb: api.KVUnlock, Key: key, Session: session},
+		&api.KVTxnOp{Verb: api.KVLock, Key: key, Value: value, Session: d.session},
+	}, d.queryOptions(ctx))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("failed to move key to the current session in consul: " + key + " " + txnErrors(resp))
+	}
+	log.Print("moved key in consul from previous session: ", session, " to the current one: ", key)
+	return nil
+}
+
+func (d *ConsulDcs) UnAdvertiseInDCS() {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//remove key for this node, so it is no longer counted as healthy. The session is kept for the marks.
+	_, err := d.kv.Delete(d.nodeKey(), d.writeOptions(ctx))
+	if err != nil {
+		log.Print("Error in UnAdvertiseInDCS() :", err)
+	}
+}
+
+// return true when the IP is present in DCS and marked with our own name or not marked at all
+// for all other cases, we need to deregister the IP
+func (d *ConsulDcs) CheckIpInDCS(ip string) (marked bool, err error) {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	pairs, _, err := d.kv.List(d.ipKey(ip), d.queryOptions(ctx))
+	if err != nil {
+		log.Error("Error in CheckIpInDCS() :")
+		log.Error(err)
+		return false, err
+	}
+	if len(pairs) == 0 {
+		log.Error("IP address is not part of the pool in DCS: ", ip)
+		return false, nil
+	}
+	for _, p := range pairs {
+		if p.Key != d.markedKey(ip) || p.Session == "" {
+			continue
+		}
+		if d.isOwn(p) {
+			err := d.adopt(ctx, p.Key, p.Value, p.Session)
+			if err != nil {
+				log.Error("Error in CheckIpInDCS() :")
+				log.Error(err)
+				return false, err
+			}
+			log.Debug("Validated DCS marker for registered IP: ", ip)
+			return true, nil
+		}
+		log.Error("Found DCS marker by other yaim: "+string(p.Value)+" for locally registered IP: ", ip)
+		return false, nil
+	}
+	log.Print("Trying to retroactively mark locally registered IP address: " + ip + " in DCS")
+	return d.MarkIpInDCS(ip)
+}
+
+func (d *ConsulDcs) MarkIpInDCS(ip string) (success bool, err error) {
+	if d.session == "" {
+		err := d.renewSession()
+		if err != nil {
+			log.Print("Error in MarkIpInDCS() :", err)
+			return false, err
+		}
+	}
+
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//acquire "marked" key for this node, only if the IP is still in the pool and nobody else holds it.
+	ok, resp, _, err := d.kv.Txn(api.KVTxnOps{
+		&api.KVTxnOp{Verb: api.KVGet, Key: d.ipKey(ip)},
+		&api.KVTxnOp{Verb: api.KVLock, Key: d.markedKey(ip), Value: []byte(d.conf().Nodename), Session: d.session},
+	}, d.queryOptions(ctx))
+	if err != nil {
+		log.Print("Error in MarkIpInDCS() :", err)
+		return false, err
+	}
+	if !ok {
+		log.Print("Error in MarkIpInDCS() : IP is not in the pool or has already been marked: ", ip, " ", txnErrors(resp))
+		return false, nil
+	}
+	log.Print("marked IP in consul: ", ip)
+	return true, nil
+}
+
+// The "marked" keys are held by the session of this node, which is renewed in AdvertiseInDCS().
+func (d *ConsulDcs) RefreshMarkIpInDCS(ip string) error {
+	log.Debug("Mark for IP in consul is refreshed through the session: ", ip)
+	return nil
+}
+
+func (d *ConsulDcs) UnMarkIpInDCS(ip string) error {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//release and remove "marked" key, only if it is held by our session.
+	ok, resp, _, err := d.kv.Txn(api.KVTxnOps{
+		&api.KVTxnOp{Verb: api.KVUnlock, Key: d.markedKey(ip), Session: d.session},
+		&api.KVTxnOp{Verb: api.KVDelete, Key: d.markedKey(ip)},
+	}, d.queryOptions(ctx))
+	if err != nil {
+		log.Print("Error in UnMarkIpInDCS() :", err)
+		return err
+	}
+	if !ok {
+		log.Print("Error in UnMarkIpInDCS() : IP is not marked by this node: ", ip, " ", txnErrors(resp))
+		return nil
+	}
+	log.Print("removed mark for IP in consul: ", ip)
+	return nil
+}
+
+func (d *ConsulDcs) UnMarkAllIPs(ips []string) {
+	for _, ip := range ips {
+		d.UnMarkIpInDCS(ip)
+	}
+}
+
+// getMaintenance returns all nodes in maintenance.
+func (d *ConsulDcs) getMaintenance(ctx context.Context) (map[string]bool, error) {
+	keys, _, err := d.kv.Keys(d.basepath+"maintenance/", "", d.queryOptions(ctx))
+	if err != nil {
+		return nil, err
+	}
+	maintenance := make(map[string]bool)
+	for _, k := range keys {
+		maintenance[strings.TrimPrefix(k, d.basepath+"maintenance/")] = true
+	}
+	return maintenance, nil
+}
+
+func (d *ConsulDcs) GetIPs() (IPs, ownMarkedIPs, unmarkedIPs []string, err error) {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//retrieve all ips and their marks.
+	pairs, _, err := d.kv.List(d.basepath+"ips/", d.queryOptions(ctx))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	marks := make(map[string]*api.KVPair)
+	for _, p := range pairs {
+		key := strings.TrimPrefix(p.Key, d.basepath+"ips/")
+		if !strings.Contains(strings.TrimSuffix(key, "/"), "/") {
+			if err := checkIPKey(strings.TrimSuffix(key, "/")); err != nil {
+				log.Error("ignoring entry ", p.Key, ": ", err)
+				continue
+			}
+			IPs = append(IPs, strings.TrimSuffix(key, "/"))
+			continue
+		}
+		//a "marked" key that is not held by any session is a leftover and doesn't count.
+		if strings.HasSuffix(key, "/marked") && p.Session != "" {
+			marks[strings.TrimSuffix(key, "/marked")] = p
+		}
+	}
+
+	for _, ip := range IPs {
+		mark, marked := marks[ip]
+		if !marked {
+			unmarkedIPs = append(unmarkedIPs, ip)
+		} else if d.isOwn(mark) {
+			log.Debug("our own marked value found!")
+			// the mark would be deleted along with the previous session, even though the current one is renewed.
+			err := d.adopt(ctx, mark.Key, mark.Value, mark.Session)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			ownMarkedIPs = append(ownMarkedIPs, ip)
+		}
+	}
+	return IPs, ownMarkedIPs, unmarkedIPs, nil
+}
+
+func (d *ConsulDcs) GetIPSpecs() (specs map[string]config.IPSpec, err error) {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//retrieve all keys below the ips, the specs are filtered out below.
+	pairs, _, err := d.kv.List(d.basepath+"ips/", d.queryOptions(ctx))
+	if err != nil {
+		return nil, err
+	}
+	specs = make(map[string]config.IPSpec)
+	for _, p := range pairs {
+		key := strings.TrimPrefix(p.Key, d.basepath+"ips/")
+		if !strings.HasSuffix(key, "/spec") {
+			continue
+		}
+		ip := strings.TrimSuffix(key, "/spec")
+		spec, err := config.ParseIPSpec(string(p.Value))
+		if err != nil {
+			log.Error("ignoring invalid spec for IP address ", ip, ": ", err)
+			continue
+		}
+		specs[ip] = spec
+	}
+	return specs, nil
+}
+
+func (d *ConsulDcs) AddIPToPool(ip string, spec string) error {
+	err := checkIPKey(ip)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//a check-and-set with an index of 0 only succeeds if the key doesn't exist yet.
+	ops := api.KVTxnOps{
+		&api.KVTxnOp{Verb: api.KVCAS, Key: d.ipKey(ip), Index: 0},
+	}
+	if spec != "" {
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVSet, Key: d.specKey(ip), Value: []byte(spec)})
+	}
+	ok, _, _, err := d.kv.Txn(ops, d.queryOptions(ctx))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("IP address is already part of the pool: " + ip)
+	}
+	return nil
+}
+
+func (d *ConsulDcs) RemoveIPFromPool(ip string) error {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	pair, _, err := d.kv.Get(d.ipKey(ip), d.queryOptions(ctx))
+	if err != nil {
+		return err
+	}
+	if pair == nil {
+		return errors.New("IP address is not part of the pool: " + ip)
+	}
+	//the folder key ends with a slash, so this doesn't touch e.g. 10.0.0.10 when removing 10.0.0.1.
+	_, err = d.kv.DeleteTree(d.ipKey(ip), d.writeOptions(ctx))
+	return err
+}
+
+func (d *ConsulDcs) SetIPSpec(ip string, spec string) error {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	op := &api.KVTxnOp{Verb: api.KVSet, Key: d.specKey(ip), Value: []byte(spec)}
+	if spec == "" {
+		op = &api.KVTxnOp{Verb: api.KVDelete, Key: d.specKey(ip)}
+	}
+	ok, resp, _, err := d.kv.Txn(api.KVTxnOps{
+		&api.KVTxnOp{Verb: api.KVGet, Key: d.ipKey(ip)},
+		op,
+	}, d.queryOptions(ctx))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("IP address is not part of the pool: " + ip + " " + txnErrors(resp))
+	}
+	return nil
+}
+
+func (d *ConsulDcs) ForceUnMarkIP(ip string) error {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	pair, _, err := d.kv.Get(d.markedKey(ip), d.queryOptions(ctx))
+	if err != nil {
+		return err
+	}
+	if pair == nil {
+		return errors.New("IP address is not marked: " + ip)
+	}
+	//deleting a key doesn't require holding its lock.
+	_, err = d.kv.Delete(d.markedKey(ip), d.writeOptions(ctx))
+	return err
+}
+
+// Consul doesn't expose the remaining TTL of a session, so it is reported as unknown.
+func (d *ConsulDcs) GetPoolState() (*PoolState, error) {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	state := &PoolState{}
+	pairs, _, err := d.kv.List(d.basepath+"ips/", d.queryOptions(ctx))
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int)
+	for _, p := range pairs {
+		key := strings.TrimPrefix(p.Key, d.basepath+"ips/")
+		if !strings.Contains(strings.TrimSuffix(key, "/"), "/") {
+			index[strings.TrimSuffix(key, "/")] = len(state.IPs)
+			state.IPs = append(state.IPs, IPState{IP: strings.TrimSuffix(key, "/")})
+			continue
+		}
+		ip := key[:strings.Index(key, "/")]
+		i, ok := index[ip]
+		if !ok {
+			continue
+		}
+		switch strings.TrimPrefix(key, ip+"/") {
+		case "marked":
+			if p.Session != "" {
+				state.IPs[i].Holder = string(p.Value)
+			}
+		case "spec":
+			state.IPs[i].Spec = string(p.Value)
+		case "claim":
+			if p.Session != "" {
+				state.IPs[i].Claim = string(p.Value)
+			}
+		}
+	}
+
+	pairs, _, err = d.kv.List(d.basepath+"nodes/", d.queryOptions(ctx))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pairs {
+		if p.Session == "" {
+			continue
+		}
+		state.Nodes = append(state.Nodes, NodeState{
+			Name:  strings.TrimPrefix(p.Key, d.basepath+"nodes/"),
+			Value: string(p.Value),
+		})
+	}
+
+	maintenance, err := d.getMaintenance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for node := range maintenance {
+		state.Maintenance = append(state.Maintenance, node)
+	}
+	sort.Strings(state.Maintenance)
+	return state, nil
+}
+
+func (d *ConsulDcs) ClaimIpInDCS(ip string) (success bool, err error) {
+	if d.session == "" {
+		err := d.renewSession()
+		if err != nil {
+			log.Print("Error in ClaimIpInDCS() :", err)
+			return false, err
+		}
+	}
+
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//acquire "claim" key for this node, acquiring it again with the same session succeeds as well.
+	acquired, _, err := d.kv.Acquire(&api.KVPair{
+		Key:     d.claimKey(ip),
+		Value:   []byte(d.conf().Nodename),
+		Session: d.session,
+	}, d.writeOptions(ctx))
+	if err != nil {
+		log.Print("Error in ClaimIpInDCS() :", err)
+		return false, err
+	}
+	if !acquired {
+		log.Print("Error in ClaimIpInDCS() : IP has already been claimed: ", ip)
+		return false, nil
+	}
+	// acquiring our own claim again succeeds as well, so this happens on every loop until the IP has been handed over.
+	log.Debug("claimed IP in consul: ", ip)
+	return true, nil
+}
+
+func (d *ConsulDcs) UnClaimIpInDCS(ip string) error {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//release and remove "claim" key, only if it is held by our session.
+	ok, resp, _, err := d.kv.Txn(api.KVTxnOps{
+		&api.KVTxnOp{Verb: api.KVUnlock, Key: d.claimKey(ip), Session: d.session},
+		&api.KVTxnOp{Verb: api.KVDelete, Key: d.claimKey(ip)},
+	}, d.queryOptions(ctx))
+	if err != nil {
+		log.Print("Error in UnClaimIpInDCS() :", err)
+		return err
+	}
+	if !ok {
+		log.Print("Error in UnClaimIpInDCS() : IP is not claimed by this node: ", ip, " ", txnErrors(resp))
+		return nil
+	}
+	log.Print("removed claim for IP in consul: ", ip)
+	return nil
+}
+
+func (d *ConsulDcs) SetMaintenance(node string, enabled bool) error {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	var err error
+	if enabled {
+		_, err = d.kv.Put(&api.KVPair{Key: d.basepath + "maintenance/" + node, Value: []byte("true")}, d.writeOptions(ctx))
+	} else {
+		_, err = d.kv.Delete(d.basepath+"maintenance/"+node, d.writeOptions(ctx))
+	}
+	return err
+}
+
+func txnErrors(resp *api.KVTxnResponse) string {
+	if resp == nil {
+		return ""
+	}
+	var s []string
+	for _, e := range resp.Errors {
+		s = append(s, fmt.Sprintf("(op %d: %s)", e.OpIndex, e.What))
+	}
+	return strings.Join(s, " ")
+}
+
+// Watch uses blocking queries, as Consul has no watches of its own.
+// Every refresh of a key increases the index, so the keys are compared with the previous result to find actual changes.
+func (d *ConsulDcs) Watch(ctx context.Context) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		var index uint64
+		var previous map[string]string
+		for {
+			q := &api.QueryOptions{WaitIndex: index}
+			pairs, meta, err := d.kv.List(d.basepath, q.WithContext(ctx))
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Error("Error while watching keys in consul:")
+				log.Error(err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Duration(d.conf().RetryAfter) * time.Millisecond):
+				}
+				continue
+			}
+			// the index must only ever increase, otherwise it needs to be reset.
+			if meta.LastIndex < index {
+				index = 0
+			} else {
+				index = meta.LastIndex
+			}
+
+			//keys without a session don't count in many places, so losing the session is a change as well.
+			current := make(map[string]string)
+			for _, p := range pairs {
+				current[p.Key] = string(p.Value) + "\x00" + p.Session
+			}
+			if previous != nil && !equalPairs(previous, current) {
+				log.Debug("Watched change in consul at index: ", index)
+				notify.Send(changes)
+			}
+			previous = current
+		}
+	}()
+	return changes
+}
+
+func equalPairs(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
@@ -3,17 +3,19 @@ package dcs
 import (
 	"context"
 	"errors"
+	"sort"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/cybertec-postgresql/yaim/config"
+	"github.com/cybertec-postgresql/yaim/notify"
 	"go.etcd.io/etcd/client/v2"
 )
 
 type EtcdDcs struct {
-	conf             *config.Config
+	shared           *config.Shared
 	basepath         string
 	cfg              client.Config
 	cl               client.Client
@@ -24,18 +26,22 @@ type EtcdDcs struct {
 	dirSetOpts       *client.SetOptions
 }
 
-func NewEtcdDcs(conf *config.Config) (*EtcdDcs, error) {
+func (d *EtcdDcs) conf() *config.Config {
+	return d.shared.Get()
+}
+
+func NewEtcdDcs(conf *config.Shared) (*EtcdDcs, error) {
 	var err error
 	var d EtcdDcs
 
-	d.conf = conf
-	d.basepath = conf.DcsNamespace + conf.DcsClusterName + "/"
+	d.shared = conf
+	d.basepath = d.conf().DcsNamespace + d.conf().DcsClusterName + "/"
 	d.cfg = client.Config{
-		Endpoints: d.conf.DcsEndpoints,
+		Endpoints: d.conf().DcsEndpoints,
 		Transport: client.DefaultTransport,
 		//HeaderTimeoutPerRequest: time.Second,
-		Username: d.conf.EtcdUser,
-		Password: d.conf.EtcdPassword,
+		Username: d.conf().EtcdUser,
+		Password: d.conf().EtcdPassword,
 	}
 
 	d.cl, err = client.New(d.cfg)
@@ -55,7 +61,7 @@ func NewEtcdDcs(conf *config.Config) (*EtcdDcs, error) {
 		Quorum:    true,
 	}
 	d.ttlSetOpts = &client.SetOptions{
-		TTL: time.Duration(d.conf.TTL) * time.Millisecond,
+		TTL: time.Duration(d.conf().TTL) * time.Millisecond,
 	}
 	d.dirSetOpts = &client.SetOptions{
 		Dir:       true,
@@ -80,66 +86,81 @@ func NewEtcdDcs(conf *config.Config) (*EtcdDcs, error) {
 	return &d, nil
 }
 
-func (d *EtcdDcs) AdvertiseInDCS() {
+func (d *EtcdDcs) AdvertiseInDCS() error {
 	//create key for this node in the DCS, if it exists this will simply update the TTL.
-	_, err := d.kapi.Set(context.Background(), d.basepath+"nodes/"+d.conf.Nodename, "healthy", d.ttlSetOpts)
+	_, err := d.kapi.Set(context.Background(), d.basepath+"nodes/"+d.conf().Nodename, advertisement(d.conf()), d.ttlSetOpts)
+	return err
+}
+
+func (d *EtcdDcs) UnAdvertiseInDCS() {
+	//remove key for this node in the DCS, so it is no longer counted as healthy.
+	_, err := d.kapi.Delete(context.Background(), d.basepath+"nodes/"+d.conf().Nodename, nil)
 	if err != nil {
-		log.Print(err)
+		if client.IsKeyNotFound(err) {
+			return
+		}
+		log.Print("Error in UnAdvertiseInDCS() :", err)
+		return
 	}
+	log.Print("removed advertisement for this node in etcd")
 }
 
 // return true when the IP is present in DCS and marked with our own name or not marked at all
 // for all other cases, we need to deregister the IP
-func (d *EtcdDcs) CheckIpInDCS(ip string) bool {
+func (d *EtcdDcs) CheckIpInDCS(ip string) (marked bool, err error) {
 	//create "marked" key for this node in the directory of ip in DCS
 	resp, err := d.kapi.Get(context.Background(), d.basepath+"ips/"+ip, d.getRecursiveOpts)
 	if err != nil {
 		log.Error("Error in CheckIpInDCS() :")
 		log.Error(err)
-		return false
-	}
-	if len(resp.Node.Nodes) == 0 {
-		//no keys in directory
-		log.Print("Trying to retroactively mark locally registered IP address: " + ip + " in DCS")
-		return d.MarkIpInDCS(ip)
+		if client.IsKeyNotFound(err) {
+			// the IP is not part of the pool.
+			return false, nil
+		}
+		return false, err
 	}
 	for _, n := range resp.Node.Nodes {
-		key := strings.TrimPrefix(n.Key, d.basepath+"ips/"+ip)
+		key := strings.TrimPrefix(n.Key, d.basepath+"ips/"+ip+"/")
 		if key == "marked" {
-			if n.Value == d.conf.Nodename {
+			if n.Value == d.conf().Nodename {
 				log.Debug("Validated DCS marker for registered IP: ", ip)
-				return true
+				return true, nil
 			} else {
 				log.Error("Found DCS marker by other yaim: "+n.Value+" for locally registered IP: ", ip)
-				log.Error(err)
-				return false
+				return false, nil
 			}
 		}
 	}
-	return true
+	//no "marked" key in directory, there might be a spec though
+	log.Print("Trying to retroactively mark locally registered IP address: " + ip + " in DCS")
+	return d.MarkIpInDCS(ip)
 }
 
-func (d *EtcdDcs) MarkIpInDCS(ip string) (success bool) {
+func (d *EtcdDcs) MarkIpInDCS(ip string) (success bool, err error) {
 	opts := &client.SetOptions{
 		PrevExist: client.PrevNoExist,
-		TTL:       time.Duration(d.conf.TTL) * time.Millisecond,
+		TTL:       time.Duration(d.conf().TTL) * time.Millisecond,
 	}
 
 	//create "marked" key for this node in the directory of ip in DCS
-	_, err := d.kapi.Set(context.Background(), d.basepath+"ips/"+ip+"/marked", d.conf.Nodename, opts)
+	_, err = d.kapi.Set(context.Background(), d.basepath+"ips/"+ip+"/marked", d.conf().Nodename, opts)
 	if err != nil {
 		log.Print("Error in MarkIpInDCS() :", err)
-		return false
+		if isRejected(err, client.ErrorCodeNodeExist) {
+			// somebody else has marked the IP already.
+			return false, nil
+		}
+		return false, err
 	} else {
 		log.Print("marked IP in etcd: ", ip)
 	}
-	return true
+	return true, nil
 }
 
-func (d *EtcdDcs) RefreshMarkIpInDCS(ip string) {
+func (d *EtcdDcs) RefreshMarkIpInDCS(ip string) error {
 	opts := &client.SetOptions{
-		PrevValue: d.conf.Nodename,
-		TTL:       time.Duration(d.conf.TTL) * time.Millisecond,
+		PrevValue: d.conf().Nodename,
+		TTL:       time.Duration(d.conf().TTL) * time.Millisecond,
 		Refresh:   true,
 	}
 
@@ -151,19 +172,26 @@ func (d *EtcdDcs) RefreshMarkIpInDCS(ip string) {
 	} else {
 		log.Print("Updated TTL for marked IP in etcd: ", ip)
 	}
+	return err
 }
 
-func (d *EtcdDcs) UnMarkIpInDCS(ip string) {
+func (d *EtcdDcs) UnMarkIpInDCS(ip string) error {
 	opts := &client.DeleteOptions{
-		PrevValue: d.conf.Nodename,
+		PrevValue: d.conf().Nodename,
 	}
 
 	//remove "marked" key for this node in the directory of ip in DCS, only if the value (nodeName) is "ours".
 	_, err := d.kapi.Delete(context.Background(), d.basepath+"ips/"+ip+"/marked", opts)
 	if err != nil {
 		log.Print("Error in UnMarkIpInDCS() :", err)
+		if isRejected(err, client.ErrorCodeKeyNotFound, client.ErrorCodeTestFailed) {
+			// the IP is not marked by this node.
+			return nil
+		}
+		return err
 	}
 	log.Print("removed mark for IP in etcd: ", ip)
+	return nil
 }
 
 func (d *EtcdDcs) UnMarkAllIPs(ips []string) {
@@ -172,17 +200,21 @@ func (d *EtcdDcs) UnMarkAllIPs(ips []string) {
 	}
 }
 
-func (d *EtcdDcs) GetNumberAdvertisments() (num int, err error) {
-	//retrieve all advertised nodes
-	resp, err := d.kapi.Get(context.Background(), d.basepath+"nodes", d.getRecursiveOpts)
-	if err == nil {
-		if resp.Node.Dir {
-			return len(resp.Node.Nodes), nil
-		} else {
-			err = errors.New("no advertisments of any nodes (including my own, apparently) where found")
+// getMaintenance returns all nodes in maintenance.
+func (d *EtcdDcs) getMaintenance() (map[string]bool, error) {
+	maintenance := make(map[string]bool)
+	resp, err := d.kapi.Get(context.Background(), d.basepath+"maintenance", d.getRecursiveOpts)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			//no node has ever been in maintenance.
+			return maintenance, nil
 		}
+		return nil, err
 	}
-	return -1, err
+	for _, n := range resp.Node.Nodes {
+		maintenance[strings.TrimPrefix(n.Key, d.basepath+"maintenance/")] = true
+	}
+	return maintenance, nil
 }
 
 func (d *EtcdDcs) GetIPs() (IPs, ownMarkedIPs, unmarkedIPs []string, err error) {
@@ -198,21 +230,27 @@ func (d *EtcdDcs) GetIPs() (IPs, ownMarkedIPs, unmarkedIPs []string, err error)
 	//var numIps []string
 	for _, n := range resp.Node.Nodes {
 		ip := strings.TrimPrefix(n.Key, d.basepath+"ips/")
+		if err := checkIPKey(ip); err != nil {
+			log.Error("ignoring entry ", n.Key, ": ", err)
+			continue
+		}
 		if n.Dir {
 			//we only want to count the IP adresses that we can actually manage (by putting a key in the directory)
 			IPs = append(IPs, ip)
+			marked := false
 			for _, nn := range n.Nodes {
 				//If the first entry in the directory of this ip has a key of "marked", we'll count it as this IP being used by any yaim.
 				if strings.TrimPrefix(nn.Key, d.basepath+"ips/"+ip+"/") == "marked" {
 					log.Debug("marked value found!")
+					marked = true
 					//If the first entry in the directory of this ip has a value of our own nodeName, we'll count it as this IP being used by _this_ yaim.
-					if nn.Value == d.conf.Nodename {
+					if nn.Value == d.conf().Nodename {
 						log.Debug("our own marked value found!")
 						ownMarkedIPs = append(ownMarkedIPs, strings.TrimPrefix(n.Key, d.basepath+"ips/"))
 					}
 				}
 			}
-			if len(n.Nodes) <= 0 {
+			if !marked {
 				//IP not marked!
 				unmarkedIPs = append(unmarkedIPs, strings.TrimPrefix(n.Key, d.basepath+"ips/"))
 			}
@@ -222,3 +260,254 @@ func (d *EtcdDcs) GetIPs() (IPs, ownMarkedIPs, unmarkedIPs []string, err error)
 	}
 	return IPs, ownMarkedIPs, unmarkedIPs, err
 }
+
+func (d *EtcdDcs) GetIPSpecs() (specs map[string]config.IPSpec, err error) {
+	//retrieve all ips, including their specs.
+	resp, err := d.kapi.Get(context.Background(), d.basepath+"ips", d.getRecursiveOpts)
+	if err != nil {
+		return nil, err
+	}
+	specs = make(map[string]config.IPSpec)
+	for _, n := range resp.Node.Nodes {
+		ip := strings.TrimPrefix(n.Key, d.basepath+"ips/")
+		for _, nn := range n.Nodes {
+			if strings.TrimPrefix(nn.Key, d.basepath+"ips/"+ip+"/") != "spec" {
+				continue
+			}
+			spec, err := config.ParseIPSpec(nn.Value)
+			if err != nil {
+				log.Error("ignoring invalid spec for IP address ", ip, ": ", err)
+				continue
+			}
+			specs[ip] = spec
+		}
+	}
+	return specs, nil
+}
+
+func (d *EtcdDcs) AddIPToPool(ip string, spec string) error {
+	err := checkIPKey(ip)
+	if err != nil {
+		return err
+	}
+	if spec == "" {
+		opts := &client.SetOptions{
+			Dir:       true,
+			PrevExist: client.PrevNoExist,
+		}
+		_, err = d.kapi.Set(context.Background(), d.basepath+"ips/"+ip, "", opts)
+		return err
+	}
+	//etcd v2 has no transactions, but setting the spec creates the directory of the ip along with it.
+	_, err = d.kapi.Get(context.Background(), d.basepath+"ips/"+ip, d.getOpts)
+	if err == nil {
+		return errors.New("IP address is already part of the pool: " + ip)
+	}
+	if !client.IsKeyNotFound(err) {
+		return err
+	}
+	opts := &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+	}
+	_, err = d.kapi.Set(context.Background(), d.basepath+"ips/"+ip+"/spec", spec, opts)
+	return err
+}
+
+func (d *EtcdDcs) RemoveIPFromPool(ip string) error {
+	opts := &client.DeleteOptions{
+		Dir:       true,
+		Recursive: true,
+	}
+	_, err := d.kapi.Delete(context.Background(), d.basepath+"ips/"+ip, opts)
+	return err
+}
+
+func (d *EtcdDcs) SetIPSpec(ip string, spec string) error {
+	//setting a key inside of a directory that doesn't exist would create the directory, thus adding the ip to the pool.
+	resp, err := d.kapi.Get(context.Background(), d.basepath+"ips/"+ip, d.getOpts)
+	if err != nil {
+		return err
+	}
+	if !resp.Node.Dir {
+		return errors.New("entries for IP addresses need to be directories, " + resp.Node.Key + " is a key.")
+	}
+	if spec == "" {
+		_, err = d.kapi.Delete(context.Background(), d.basepath+"ips/"+ip+"/spec", nil)
+		if client.IsKeyNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	_, err = d.kapi.Set(context.Background(), d.basepath+"ips/"+ip+"/spec", spec, nil)
+	return err
+}
+
+func (d *EtcdDcs) ForceUnMarkIP(ip string) error {
+	_, err := d.kapi.Delete(context.Background(), d.basepath+"ips/"+ip+"/marked", nil)
+	return err
+}
+
+// remaining returns the time until the node expires, or 0 if it doesn't expire.
+func remaining(n *client.Node) time.Duration {
+	if n.Expiration == nil {
+		return 0
+	}
+	return time.Until(*n.Expiration)
+}
+
+func (d *EtcdDcs) GetPoolState() (*PoolState, error) {
+	state := &PoolState{}
+
+	resp, err := d.kapi.Get(context.Background(), d.basepath+"ips", d.getRecursiveOpts)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range resp.Node.Nodes {
+		ipState := IPState{IP: strings.TrimPrefix(n.Key, d.basepath+"ips/")}
+		for _, nn := range n.Nodes {
+			switch strings.TrimPrefix(nn.Key, n.Key+"/") {
+			case "marked":
+				ipState.Holder = nn.Value
+				ipState.TTL = remaining(nn)
+			case "spec":
+				ipState.Spec = nn.Value
+			case "claim":
+				ipState.Claim = nn.Value
+			}
+		}
+		state.IPs = append(state.IPs, ipState)
+	}
+
+	resp, err = d.kapi.Get(context.Background(), d.basepath+"nodes", d.getRecursiveOpts)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range resp.Node.Nodes {
+		state.Nodes = append(state.Nodes, NodeState{
+			Name:  strings.TrimPrefix(n.Key, d.basepath+"nodes/"),
+			Value: n.Value,
+			TTL:   remaining(n),
+		})
+	}
+
+	maintenance, err := d.getMaintenance()
+	if err != nil {
+		return nil, err
+	}
+	for node := range maintenance {
+		state.Maintenance = append(state.Maintenance, node)
+	}
+	sort.Strings(state.Maintenance)
+	return state, nil
+}
+
+func (d *EtcdDcs) ClaimIpInDCS(ip string) (success bool, err error) {
+	opts := &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+		TTL:       time.Duration(d.conf().TTL) * time.Millisecond,
+	}
+
+	//create "claim" key for this node in the directory of ip in DCS, or refresh it if it is "ours" already.
+	_, err = d.kapi.Set(context.Background(), d.basepath+"ips/"+ip+"/claim", d.conf().Nodename, opts)
+	if isRejected(err, client.ErrorCodeNodeExist) {
+		opts = &client.SetOptions{
+			PrevValue: d.conf().Nodename,
+			TTL:       time.Duration(d.conf().TTL) * time.Millisecond,
+		}
+		_, err = d.kapi.Set(context.Background(), d.basepath+"ips/"+ip+"/claim", d.conf().Nodename, opts)
+		if err == nil {
+			log.Debug("Updated TTL for claimed IP in etcd: ", ip)
+			return true, nil
+		}
+		if isRejected(err, client.ErrorCodeKeyNotFound, client.ErrorCodeTestFailed) {
+			log.Print("Error in ClaimIpInDCS() : IP has already been claimed: ", ip)
+			return false, nil
+		}
+	}
+	if err != nil {
+		log.Print("Error in ClaimIpInDCS() :", err)
+		return false, err
+	}
+	log.Print("claimed IP in etcd: ", ip)
+	return true, nil
+}
+
+func (d *EtcdDcs) UnClaimIpInDCS(ip string) error {
+	opts := &client.DeleteOptions{
+		PrevValue: d.conf().Nodename,
+	}
+
+	//remove "claim" key for this node in the directory of ip in DCS, only if the value (nodeName) is "ours".
+	_, err := d.kapi.Delete(context.Background(), d.basepath+"ips/"+ip+"/claim", opts)
+	if err != nil {
+		log.Print("Error in UnClaimIpInDCS() :", err)
+		if isRejected(err, client.ErrorCodeKeyNotFound, client.ErrorCodeTestFailed) {
+			// the IP is not claimed by this node.
+			return nil
+		}
+		return err
+	}
+	log.Print("removed claim for IP in etcd: ", ip)
+	return nil
+}
+
+// isRejected returns true if etcd has refused the request because of the state of the key, with one of the given codes,
+// rather than failing to process it.
+func isRejected(err error, codes ...int) bool {
+	e, ok := err.(client.Error)
+	if !ok {
+		return false
+	}
+	for _, code := range codes {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *EtcdDcs) SetMaintenance(node string, enabled bool) error {
+	if !enabled {
+		_, err := d.kapi.Delete(context.Background(), d.basepath+"maintenance/"+node, nil)
+		if client.IsKeyNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	_, err := d.kapi.Set(context.Background(), d.basepath+"maintenance/"+node, "true", nil)
+	return err
+}
+
+func (d *EtcdDcs) Watch(ctx context.Context) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		watcher := d.kapi.Watcher(d.basepath, &client.WatcherOptions{Recursive: true})
+		for {
+			resp, err := watcher.Next(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Error("Error while watching keys in etcd:")
+				log.Error(err)
+				//start over from the current index, changes might have been missed in the meantime.
+				notify.Send(changes)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Duration(d.conf().RetryAfter) * time.Millisecond):
+				}
+				watcher = d.kapi.Watcher(d.basepath, &client.WatcherOptions{Recursive: true})
+				continue
+			}
+			//setting the same value again is how the TTL of the advertisement and the claims is updated.
+			if resp.Action != "delete" && resp.Action != "compareAndDelete" && resp.Action != "expire" &&
+				resp.PrevNode != nil && resp.PrevNode.Value == resp.Node.Value {
+				continue
+			}
+			log.Debug("Watched change in etcd: ", resp.Action, " ", resp.Node.Key)
+			notify.Send(changes)
+		}
+	}()
+	return changes
+}
@@ -0,0 +1,620 @@
+package dcs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/yaim/config"
+	"github.com/cybertec-postgresql/yaim/notify"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Etcd3Dcs uses the etcd v3 API.
+// Instead of setting a TTL on every key, this node holds a single lease.
+// The node advertisement and all "marked" keys of this node are attached to that lease,
+// so keeping the lease alive refreshes all of them at once.
+type Etcd3Dcs struct {
+	shared   *config.Shared
+	basepath string
+	cfg      clientv3.Config
+	cl       *clientv3.Client
+	leaseID  clientv3.LeaseID
+}
+
+func (d *Etcd3Dcs) conf() *config.Config {
+	return d.shared.Get()
+}
+
+func NewEtcd3Dcs(conf *config.Shared) (*Etcd3Dcs, error) {
+	var err error
+	var d Etcd3Dcs
+
+	d.shared = conf
+	d.basepath = d.conf().DcsNamespace + d.conf().DcsClusterName + "/"
+	d.leaseID = clientv3.NoLease
+
+	var tlsConfig *tls.Config
+	if d.conf().EtcdCAFile != "" || d.conf().EtcdCertFile != "" {
+		tlsInfo := transport.TLSInfo{
+			TrustedCAFile: d.conf().EtcdCAFile,
+			CertFile:      d.conf().EtcdCertFile,
+			KeyFile:       d.conf().EtcdKeyFile,
+		}
+		tlsConfig, err = tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d.cfg = clientv3.Config{
+		Endpoints:   d.conf().DcsEndpoints,
+		DialTimeout: d.conf().RequestTimeout(),
+		Username:    d.conf().EtcdUser,
+		Password:    d.conf().EtcdPassword,
+		TLS:         tlsConfig,
+	}
+
+	d.cl, err = clientv3.New(d.cfg)
+	if err != nil {
+		log.Fatal("couldn't initialize etcd client", err)
+	}
+
+	// there are no directories in etcd v3, so there is no k/v structure to be created here.
+	return &d, nil
+}
+
+func (d *Etcd3Dcs) context() (context.Context, context.CancelFunc) {
+	return d.conf().RequestContext()
+}
+
+func (d *Etcd3Dcs) nodeKey() string {
+	return d.basepath + "nodes/" + d.conf().Nodename
+}
+
+func (d *Etcd3Dcs) ipKey(ip string) string {
+	return d.basepath + "ips/" + ip
+}
+
+func (d *Etcd3Dcs) markedKey(ip string) string {
+	return d.basepath + "ips/" + ip + "/marked"
+}
+
+func (d *Etcd3Dcs) specKey(ip string) string {
+	return d.basepath + "ips/" + ip + "/spec"
+}
+
+func (d *Etcd3Dcs) claimKey(ip string) string {
+	return d.basepath + "ips/" + ip + "/claim"
+}
+
+// keepAlive refreshes the lease of this node, or grants a new one if there is none or if it has expired.
+// All keys attached to an expired lease are gone, so they will need to be recreated by the caller.
+func (d *Etcd3Dcs) keepAlive() error {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	if d.leaseID != clientv3.NoLease {
+		_, err := d.cl.KeepAliveOnce(ctx, d.leaseID)
+		if err == nil {
+			log.Debug("Refreshed lease in etcd: ", d.leaseID)
+			return nil
+		}
+		if err != rpctypes.ErrLeaseNotFound {
+			return err
+		}
+		log.Print("Lease in etcd has expired: ", d.leaseID)
+		d.leaseID = clientv3.NoLease
+	}
+
+	// etcd leases have a granularity of seconds.
+	ttl := int64(math.Ceil(float64(d.conf().TTL) / 1000))
+	resp, err := d.cl.Grant(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	d.leaseID = resp.ID
+	log.Print("Granted new lease in etcd: ", d.leaseID)
+	return nil
+}
+
+func (d *Etcd3Dcs) AdvertiseInDCS() error {
+	//refreshing the lease will also refresh all marks of this node.
+	err := d.keepAlive()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := d.context()
+	defer cancel()
+	_, err = d.cl.Put(ctx, d.nodeKey(), advertisement(d.conf()), clientv3.WithLease(d.leaseID))
+	return err
+}
+
+func (d *Etcd3Dcs) UnAdvertiseInDCS() {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//remove key for this node, so it is no longer counted as healthy. The lease is kept for the marks.
+	resp, err := d.cl.Delete(ctx, d.nodeKey())
+	if err != nil {
+		log.Print("Error in UnAdvertiseInDCS() :", err)
+		return
+	}
+	if resp.Deleted > 0 {
+		log.Print("removed advertisement for this node in etcd")
+	}
+}
+
+// return true when the IP is present in DCS and marked with our own name or not marked at all
+// for all other cases, we need to deregister the IP
+func (d *Etcd3Dcs) CheckIpInDCS(ip string) (marked bool, err error) {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	resp, err := d.cl.Txn(ctx).Then(
+		clientv3.OpGet(d.ipKey(ip)),
+		clientv3.OpGet(d.markedKey(ip)),
+	).Commit()
+	if err != nil {
+		log.Error("Error in CheckIpInDCS() :")
+		log.Error(err)
+		return false, err
+	}
+	if len(resp.Responses[0].GetResponseRange().Kvs) == 0 {
+		log.Error("IP address is not part of the pool in DCS: ", ip)
+		return false, nil
+	}
+	marks := resp.Responses[1].GetResponseRange().Kvs
+	if len(marks) == 0 {
+		log.Print("Trying to retroactively mark locally registered IP address: " + ip + " in DCS")
+		return d.MarkIpInDCS(ip)
+	}
+	if string(marks[0].Value) == d.conf().Nodename {
+		if clientv3.LeaseID(marks[0].Lease) != d.leaseID {
+			err := d.adoptMark(ip)
+			if err != nil {
+				log.Error("Error in CheckIpInDCS() :")
+				log.Error(err)
+				return false, err
+			}
+		}
+		log.Debug("Validated DCS marker for registered IP: ", ip)
+		return true, nil
+	}
+	log.Error("Found DCS marker by other yaim: "+string(marks[0].Value)+" for locally registered IP: ", ip)
+	return false, nil
+}
+
+func (d *Etcd3Dcs) MarkIpInDCS(ip string) (success bool, err error) {
+	if d.leaseID == clientv3.NoLease {
+		err := d.keepAlive()
+		if err != nil {
+			log.Print("Error in MarkIpInDCS() :", err)
+			return false, err
+		}
+	}
+
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//create "marked" key for this node, only if the IP is still in the pool and nobody else has marked it yet.
+	resp, err := d.cl.Txn(ctx).If(
+		clientv3.Compare(clientv3.CreateRevision(d.ipKey(ip)), ">", 0),
+		clientv3.Compare(clientv3.CreateRevision(d.markedKey(ip)), "=", 0),
+	).Then(
+		clientv3.OpPut(d.markedKey(ip), d.conf().Nodename, clientv3.WithLease(d.leaseID)),
+	).Commit()
+	if err != nil {
+		log.Print("Error in MarkIpInDCS() :", err)
+		return false, err
+	}
+	if !resp.Succeeded {
+		log.Print("Error in MarkIpInDCS() : IP is not in the pool or has already been marked: ", ip)
+		return false, nil
+	}
+	log.Print("marked IP in etcd: ", ip)
+	return true, nil
+}
+
+// The "marked" keys are attached to the lease of this node, which is refreshed in AdvertiseInDCS().
+// Marks of this node that are still attached to a previous lease, e.g. after a restart, are moved to the current one in GetIPs().
+func (d *Etcd3Dcs) RefreshMarkIpInDCS(ip string) error {
+	log.Debug("Mark for IP in etcd is refreshed through the lease: ", ip)
+	return nil
+}
+
+// adoptMark attaches the mark of this node to the current lease, unless it is attached to it already.
+// An error is returned if the IP isn't marked by this node (anymore).
+func (d *Etcd3Dcs) adoptMark(ip string) error {
+	if d.leaseID == clientv3.NoLease {
+		err := d.keepAlive()
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := d.context()
+	defer cancel()
+
+	resp, err := d.cl.Txn(ctx).If(
+		clientv3.Compare(clientv3.Value(d.markedKey(ip)), "=", d.conf().Nodename),
+		clientv3.Compare(clientv3.LeaseValue(d.markedKey(ip)), "!=", d.leaseID),
+	).Then(
+		clientv3.OpPut(d.markedKey(ip), d.conf().Nodename, clientv3.WithLease(d.leaseID)),
+	).Else(
+		clientv3.OpGet(d.markedKey(ip)),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if resp.Succeeded {
+		log.Print("moved mark for IP in etcd to the current lease: ", ip)
+		return nil
+	}
+	marks := resp.Responses[0].GetResponseRange().Kvs
+	if len(marks) == 0 || string(marks[0].Value) != d.conf().Nodename {
+		return errors.New("IP is not marked by this node: " + ip)
+	}
+	return nil
+}
+
+func (d *Etcd3Dcs) UnMarkIpInDCS(ip string) error {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//remove "marked" key for this node, only if the value (nodeName) is "ours".
+	resp, err := d.cl.Txn(ctx).If(
+		clientv3.Compare(clientv3.Value(d.markedKey(ip)), "=", d.conf().Nodename),
+	).Then(
+		clientv3.OpDelete(d.markedKey(ip)),
+	).Commit()
+	if err != nil {
+		log.Print("Error in UnMarkIpInDCS() :", err)
+		return err
+	}
+	if !resp.Succeeded {
+		log.Print("Error in UnMarkIpInDCS() : IP is not marked by this node: ", ip)
+		return nil
+	}
+	log.Print("removed mark for IP in etcd: ", ip)
+	return nil
+}
+
+func (d *Etcd3Dcs) UnMarkAllIPs(ips []string) {
+	for _, ip := range ips {
+		d.UnMarkIpInDCS(ip)
+	}
+}
+
+func (d *Etcd3Dcs) GetIPs() (IPs, ownMarkedIPs, unmarkedIPs []string, err error) {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//retrieve all ips and their marks.
+	resp, err := d.cl.Get(ctx, d.basepath+"ips/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	marks := make(map[string]*mvccpb.KeyValue)
+	for _, kv := range resp.Kvs {
+		key := strings.TrimPrefix(string(kv.Key), d.basepath+"ips/")
+		if !strings.Contains(key, "/") {
+			if err := checkIPKey(key); err != nil {
+				log.Error("ignoring entry ", string(kv.Key), ": ", err)
+				continue
+			}
+			IPs = append(IPs, key)
+			continue
+		}
+		if strings.HasSuffix(key, "/marked") {
+			marks[strings.TrimSuffix(key, "/marked")] = kv
+		}
+	}
+
+	for _, ip := range IPs {
+		mark, marked := marks[ip]
+		if !marked {
+			unmarkedIPs = append(unmarkedIPs, ip)
+		} else if string(mark.Value) == d.conf().Nodename {
+			log.Debug("our own marked value found!")
+			if clientv3.LeaseID(mark.Lease) != d.leaseID {
+				// the mark would expire along with the previous lease, even though the current one is refreshed.
+				err := d.adoptMark(ip)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+			}
+			ownMarkedIPs = append(ownMarkedIPs, ip)
+		}
+	}
+	return IPs, ownMarkedIPs, unmarkedIPs, nil
+}
+
+func (d *Etcd3Dcs) GetIPSpecs() (specs map[string]config.IPSpec, err error) {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//retrieve all keys below the ips, the specs are filtered out below.
+	resp, err := d.cl.Get(ctx, d.basepath+"ips/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	specs = make(map[string]config.IPSpec)
+	for _, kv := range resp.Kvs {
+		key := strings.TrimPrefix(string(kv.Key), d.basepath+"ips/")
+		if !strings.HasSuffix(key, "/spec") {
+			continue
+		}
+		ip := strings.TrimSuffix(key, "/spec")
+		spec, err := config.ParseIPSpec(string(kv.Value))
+		if err != nil {
+			log.Error("ignoring invalid spec for IP address ", ip, ": ", err)
+			continue
+		}
+		specs[ip] = spec
+	}
+	return specs, nil
+}
+
+func (d *Etcd3Dcs) AddIPToPool(ip string, spec string) error {
+	err := checkIPKey(ip)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := d.context()
+	defer cancel()
+
+	ops := []clientv3.Op{clientv3.OpPut(d.ipKey(ip), "")}
+	if spec != "" {
+		ops = append(ops, clientv3.OpPut(d.specKey(ip), spec))
+	}
+	resp, err := d.cl.Txn(ctx).If(
+		clientv3.Compare(clientv3.CreateRevision(d.ipKey(ip)), "=", 0),
+	).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return errors.New("IP address is already part of the pool: " + ip)
+	}
+	return nil
+}
+
+func (d *Etcd3Dcs) RemoveIPFromPool(ip string) error {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//the entry and all keys below it, without touching e.g. 10.0.0.10 when removing 10.0.0.1.
+	resp, err := d.cl.Txn(ctx).Then(
+		clientv3.OpDelete(d.ipKey(ip)),
+		clientv3.OpDelete(d.ipKey(ip)+"/", clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return err
+	}
+	if resp.Responses[0].GetResponseDeleteRange().Deleted == 0 {
+		return errors.New("IP address is not part of the pool: " + ip)
+	}
+	return nil
+}
+
+func (d *Etcd3Dcs) SetIPSpec(ip string, spec string) error {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	op := clientv3.OpPut(d.specKey(ip), spec)
+	if spec == "" {
+		op = clientv3.OpDelete(d.specKey(ip))
+	}
+	resp, err := d.cl.Txn(ctx).If(
+		clientv3.Compare(clientv3.CreateRevision(d.ipKey(ip)), ">", 0),
+	).Then(op).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return errors.New("IP address is not part of the pool: " + ip)
+	}
+	return nil
+}
+
+func (d *Etcd3Dcs) ForceUnMarkIP(ip string) error {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	resp, err := d.cl.Delete(ctx, d.markedKey(ip))
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return errors.New("IP address is not marked: " + ip)
+	}
+	return nil
+}
+
+func (d *Etcd3Dcs) GetPoolState() (*PoolState, error) {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	resp, err := d.cl.Txn(ctx).Then(
+		clientv3.OpGet(d.basepath+"ips/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend)),
+		clientv3.OpGet(d.basepath+"nodes/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend)),
+		clientv3.OpGet(d.basepath+"maintenance/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend)),
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	//all keys of a node share the same lease, so each lease only needs to be looked up once.
+	ttls := make(map[int64]time.Duration)
+	ttl := func(lease int64) time.Duration {
+		if lease == 0 {
+			return 0
+		}
+		if _, ok := ttls[lease]; !ok {
+			resp, err := d.cl.TimeToLive(ctx, clientv3.LeaseID(lease))
+			if err != nil || resp.TTL < 0 {
+				ttls[lease] = 0
+			} else {
+				ttls[lease] = time.Duration(resp.TTL) * time.Second
+			}
+		}
+		return ttls[lease]
+	}
+
+	state := &PoolState{}
+	index := make(map[string]int)
+	for _, kv := range resp.Responses[0].GetResponseRange().Kvs {
+		key := strings.TrimPrefix(string(kv.Key), d.basepath+"ips/")
+		if !strings.Contains(key, "/") {
+			index[key] = len(state.IPs)
+			state.IPs = append(state.IPs, IPState{IP: key})
+			continue
+		}
+		ip := key[:strings.Index(key, "/")]
+		i, ok := index[ip]
+		if !ok {
+			continue
+		}
+		switch strings.TrimPrefix(key, ip+"/") {
+		case "marked":
+			state.IPs[i].Holder = string(kv.Value)
+			state.IPs[i].TTL = ttl(kv.Lease)
+		case "spec":
+			state.IPs[i].Spec = string(kv.Value)
+		case "claim":
+			state.IPs[i].Claim = string(kv.Value)
+		}
+	}
+
+	for _, kv := range resp.Responses[1].GetResponseRange().Kvs {
+		state.Nodes = append(state.Nodes, NodeState{
+			Name:  strings.TrimPrefix(string(kv.Key), d.basepath+"nodes/"),
+			Value: string(kv.Value),
+			TTL:   ttl(kv.Lease),
+		})
+	}
+
+	for _, kv := range resp.Responses[2].GetResponseRange().Kvs {
+		state.Maintenance = append(state.Maintenance, strings.TrimPrefix(string(kv.Key), d.basepath+"maintenance/"))
+	}
+	return state, nil
+}
+
+func (d *Etcd3Dcs) ClaimIpInDCS(ip string) (success bool, err error) {
+	if d.leaseID == clientv3.NoLease {
+		err := d.keepAlive()
+		if err != nil {
+			log.Print("Error in ClaimIpInDCS() :", err)
+			return false, err
+		}
+	}
+
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//create "claim" key for this node, only if nobody else has claimed the IP yet.
+	resp, err := d.cl.Txn(ctx).If(
+		clientv3.Compare(clientv3.CreateRevision(d.claimKey(ip)), "=", 0),
+	).Then(
+		clientv3.OpPut(d.claimKey(ip), d.conf().Nodename, clientv3.WithLease(d.leaseID)),
+	).Else(
+		clientv3.OpGet(d.claimKey(ip)),
+	).Commit()
+	if err != nil {
+		log.Print("Error in ClaimIpInDCS() :", err)
+		return false, err
+	}
+	if !resp.Succeeded {
+		claims := resp.Responses[0].GetResponseRange().Kvs
+		if len(claims) > 0 && string(claims[0].Value) == d.conf().Nodename {
+			//the claim is attached to our lease, so it doesn't need to be refreshed.
+			return true, nil
+		}
+		log.Print("Error in ClaimIpInDCS() : IP has already been claimed: ", ip)
+		return false, nil
+	}
+	log.Print("claimed IP in etcd: ", ip)
+	return true, nil
+}
+
+func (d *Etcd3Dcs) UnClaimIpInDCS(ip string) error {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	//remove "claim" key for this node, only if the value (nodeName) is "ours".
+	resp, err := d.cl.Txn(ctx).If(
+		clientv3.Compare(clientv3.Value(d.claimKey(ip)), "=", d.conf().Nodename),
+	).Then(
+		clientv3.OpDelete(d.claimKey(ip)),
+	).Commit()
+	if err != nil {
+		log.Print("Error in UnClaimIpInDCS() :", err)
+		return err
+	}
+	if !resp.Succeeded {
+		log.Print("Error in UnClaimIpInDCS() : IP is not claimed by this node: ", ip)
+		return nil
+	}
+	log.Print("removed claim for IP in etcd: ", ip)
+	return nil
+}
+
+func (d *Etcd3Dcs) SetMaintenance(node string, enabled bool) error {
+	ctx, cancel := d.context()
+	defer cancel()
+
+	var err error
+	if enabled {
+		_, err = d.cl.Put(ctx, d.basepath+"maintenance/"+node, "true")
+	} else {
+		_, err = d.cl.Delete(ctx, d.basepath+"maintenance/"+node)
+	}
+	return err
+}
+
+func (d *Etcd3Dcs) Watch(ctx context.Context) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		for {
+			//the previous values are needed to tell refreshed keys apart from changed ones, e.g. the advertisement of a node.
+			for resp := range d.cl.Watch(clientv3.WithRequireLeader(ctx), d.basepath, clientv3.WithPrefix(), clientv3.WithPrevKV()) {
+				if err := resp.Err(); err != nil {
+					log.Error("Error while watching keys in etcd:")
+					log.Error(err)
+					break
+				}
+				for _, ev := range resp.Events {
+					if ev.Type == clientv3.EventTypePut && ev.PrevKv != nil &&
+						bytes.Equal(ev.PrevKv.Value, ev.Kv.Value) && ev.PrevKv.Lease == ev.Kv.Lease {
+						continue
+					}
+					log.Debug("Watched change in etcd: ", ev.Type, " ", string(ev.Kv.Key))
+					notify.Send(changes)
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			//changes might have been missed while the watch was broken.
+			notify.Send(changes)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(d.conf().RetryAfter) * time.Millisecond):
+			}
+		}
+	}()
+	return changes
+}
@@ -0,0 +1,93 @@
+package dcs
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/cybertec-postgresql/yaim/config"
+)
+
+// PoolState is the state of the pool and the advertised nodes, as found in the DCS.
+type PoolState struct {
+	IPs         []IPState
+	Nodes       []NodeState
+	Maintenance []string // nodes in maintenance, whether they are advertised or not
+}
+
+type IPState struct {
+	IP     string
+	Spec   string        // as stored in the DCS, empty if there is none
+	Holder string        // node that has marked the IP, empty if it is not marked
+	TTL    time.Duration // remaining until the mark expires, 0 if unknown
+	Claim  string        // node that is ready to take over the IP from its holder, empty if there is none
+}
+
+type NodeState struct {
+	Name  string
+	Value string
+	TTL   time.Duration // remaining until the advertisement expires, 0 if unknown
+}
+
+// NodeInfo is advertised by each node as the value of its key in nodes/.
+type NodeInfo struct {
+	Weight int               `json:"weight"`
+	MaxIPs int               `json:"max-ips,omitempty"` // 0 means no limit
+	Tags   map[string]string `json:"tags,omitempty"`
+}
+
+// Info returns what the node has advertised about itself.
+// Older versions of yaim advertise the value "healthy", which counts as a weight of 1 without a limit.
+// A weight below 1 counts as 1, the limit and the tags are kept nonetheless.
+func (n NodeState) Info() NodeInfo {
+	info := NodeInfo{Weight: 1}
+	err := json.Unmarshal([]byte(n.Value), &info)
+	if err != nil {
+		return NodeInfo{Weight: 1}
+	}
+	if info.Weight < 1 {
+		info.Weight = 1
+	}
+	return info
+}
+
+// advertisement returns the value advertised for this node.
+func advertisement(conf *config.Config) string {
+	value, err := json.Marshal(NodeInfo{Weight: conf.Weight, MaxIPs: conf.MaxIPs, Tags: conf.Tags})
+	if err != nil {
+		return "healthy"
+	}
+	return string(value)
+}
+
+func (s *PoolState) InMaintenance(node string) bool {
+	for _, n := range s.Maintenance {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Claims returns the claiming node of all IPs that have been claimed.
+func (s *PoolState) Claims() map[string]string {
+	claims := make(map[string]string)
+	for _, ip := range s.IPs {
+		if ip.Claim != "" {
+			claims[ip.IP] = ip.Claim
+		}
+	}
+	return claims
+}
+
+// Available returns all advertised nodes that are not in maintenance, sorted by name.
+func (s *PoolState) Available() []string {
+	var nodes []string
+	for _, n := range s.Nodes {
+		if !s.InMaintenance(n.Name) {
+			nodes = append(nodes, n.Name)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
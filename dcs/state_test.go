@@ -0,0 +1,42 @@
+package dcs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNodeStateInfo(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  NodeInfo
+	}{
+		{
+			name:  "advertised by an older version",
+			value: "healthy",
+			want:  NodeInfo{Weight: 1},
+		},
+		{
+			name:  "weight, limit and tags",
+			value: `{"weight": 3, "max-ips": 2, "tags": {"zone": "a"}}`,
+			want:  NodeInfo{Weight: 3, MaxIPs: 2, Tags: map[string]string{"zone": "a"}},
+		},
+		{
+			name:  "weight below 1 keeps limit and tags",
+			value: `{"weight": 0, "max-ips": 2, "tags": {"zone": "a"}}`,
+			want:  NodeInfo{Weight: 1, MaxIPs: 2, Tags: map[string]string{"zone": "a"}},
+		},
+		{
+			name:  "missing weight",
+			value: `{"tags": {"zone": "a"}}`,
+			want:  NodeInfo{Weight: 1, Tags: map[string]string{"zone": "a"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (NodeState{Name: "a", Value: tt.value}).Info(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
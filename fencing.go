@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/yaim/checker"
+	"github.com/cybertec-postgresql/yaim/config"
+	"github.com/cybertec-postgresql/yaim/ipmanager"
+)
+
+// fencer drops all addresses of this node if its advertisement and marks could not be refreshed in the DCS
+// within a fraction of the TTL, before the marks can expire and other nodes can take over the addresses.
+// The deadline is based on the monotonic clock, so changes to the wall clock don't affect it.
+type fencer struct {
+	enabled bool
+	timeout time.Duration
+	ipman   ipmanager.IPManager
+
+	mu     sync.Mutex
+	timer  *time.Timer
+	fenced bool
+}
+
+func newFencer(conf *config.Config, ipman ipmanager.IPManager) (*fencer, error) {
+	f := &fencer{
+		enabled: conf.Fencing,
+		ipman:   ipman,
+	}
+	if !f.enabled {
+		return f, nil
+	}
+	if conf.TTL <= 0 {
+		return nil, errors.New("ttl needs to be set to a value greater than 0 when fencing is enabled")
+	}
+	if conf.FencingTTLFraction <= 0 || conf.FencingTTLFraction >= 1 {
+		return nil, errors.New("fencing-ttl-fraction needs to be greater than 0 and less than 1")
+	}
+	f.timeout = time.Duration(float64(conf.TTL)*conf.FencingTTLFraction) * time.Millisecond
+
+	// the refreshes can't be more frequent than the loop, which waits for the interval and for the health check
+	// with all of its retries in between. A shorter deadline would fence a perfectly healthy node.
+	check, err := checker.MaxDuration(conf)
+	if errors.Is(err, checker.ErrNoTimeout) {
+		log.Warning("The health check has no timeout, fencing will drop all addresses if it takes longer than ", f.timeout)
+	} else if err != nil {
+		return nil, err
+	}
+	retries := time.Duration(conf.RetryNum) * (check + time.Duration(conf.RetryAfter)*time.Millisecond)
+	if loop := time.Duration(conf.Interval)*time.Millisecond + retries; f.timeout <= loop {
+		return nil, fmt.Errorf("fencing-ttl-fraction of the ttl (%s) needs to be longer than the interval plus the health check with all retries (%s)", f.timeout, loop)
+	}
+	log.Print("Fencing is enabled, addresses will be dropped if the DCS can't be refreshed within ", f.timeout)
+	return f, nil
+}
+
+// extend moves the deadline, based on the time the last successful refresh was started.
+func (f *fencer) extend(refreshStarted time.Time) {
+	if !f.enabled {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// time.Until uses the monotonic clock reading of refreshStarted.
+	remaining := time.Until(refreshStarted.Add(f.timeout))
+	if remaining <= 0 {
+		// the deadline has passed while the refresh was still going on, so the addresses are dropped right away.
+		// The timer is armed nonetheless, as the addresses may have been added again since it has fired.
+		log.Print("Refreshing advertisement and marks in DCS took too long, fencing right away.")
+		remaining = 0
+	}
+	if f.timer == nil {
+		f.timer = time.AfterFunc(remaining, f.fence)
+	} else {
+		f.timer.Stop()
+		f.timer.Reset(remaining)
+	}
+	if f.fenced && remaining > 0 {
+		log.Print("Refreshed advertisement and marks in DCS again, no longer fenced.")
+		f.fenced = false
+	}
+}
+
+// stop disarms the fencer, e.g. when the node has released all addresses on its own.
+func (f *fencer) stop() {
+	if !f.enabled {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+}
+
+// reconfigure applies new fencing settings, the current deadline is kept.
+// The settings are only changed if they are valid.
+func (f *fencer) reconfigure(conf *config.Config) error {
+	updated, err := newFencer(conf, f.ipman)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.enabled && !updated.enabled && f.timer != nil {
+		f.timer.Stop()
+	}
+	f.enabled = updated.enabled
+	f.timeout = updated.timeout
+	return nil
+}
+
+func (f *fencer) fence() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.fenced = true
+	log.Error("Could not refresh advertisement and marks in DCS for ", f.timeout, ", dropping all addresses.")
+	f.ipman.DeleteAllIP()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cybertec-postgresql/yaim/config"
+)
+
+// fencingConf returns a configuration with a fencing deadline of ttl*fraction milliseconds,
+// a loop of 100ms and a tcp health check taking at most 50ms.
+func fencingConf(ttl int, fraction float64) *config.Config {
+	return &config.Config{
+		Fencing:            true,
+		TTL:                ttl,
+		FencingTTLFraction: fraction,
+		Interval:           100,
+		RetryNum:           1,
+		CheckerType:        "tcp",
+		TcpTimeout:         50,
+	}
+}
+
+func TestNewFencer(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        *config.Config
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{
+			name: "disabled",
+			conf: &config.Config{},
+		},
+		{
+			name:        "deadline after the loop and the health check",
+			conf:        fencingConf(1000, 0.5),
+			wantTimeout: 500 * time.Millisecond,
+		},
+		{
+			name:    "without ttl",
+			conf:    fencingConf(0, 0.5),
+			wantErr: true,
+		},
+		{
+			name:    "fraction of 0",
+			conf:    fencingConf(1000, 0),
+			wantErr: true,
+		},
+		{
+			name:    "fraction of 1",
+			conf:    fencingConf(1000, 1),
+			wantErr: true,
+		},
+		{
+			name:    "deadline within the interval",
+			conf:    fencingConf(100, 0.5),
+			wantErr: true,
+		},
+		{
+			name:    "deadline within the interval and the health check",
+			conf:    fencingConf(300, 0.5),
+			wantErr: true,
+		},
+		{
+			name: "deadline within the retries of the health check",
+			conf: func() *config.Config {
+				conf := fencingConf(1000, 0.5)
+				conf.RetryNum = 3
+				conf.RetryAfter = 100
+				return conf
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "health check without a timeout",
+			conf: func() *config.Config {
+				conf := fencingConf(1000, 0.5)
+				conf.CheckerType = "http"
+				return conf
+			}(),
+			wantTimeout: 500 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newFencer(tt.conf, newFakeIPManager())
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("configuration accepted with a deadline of %s", f.timeout)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.timeout != tt.wantTimeout {
+				t.Errorf("got a deadline of %s, want %s", f.timeout, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+// droppingIPManager reports when all addresses are dropped.
+type droppingIPManager struct {
+	*fakeIPManager
+	dropped chan struct{}
+}
+
+func (m *droppingIPManager) DeleteAllIP() {
+	m.dropped <- struct{}{}
+}
+
+func newTestFencer(t *testing.T) (*fencer, chan struct{}) {
+	t.Helper()
+	ipman := &droppingIPManager{fakeIPManager: newFakeIPManager(), dropped: make(chan struct{}, 10)}
+	f, err := newFencer(fencingConf(1000, 0.5), ipman)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.stop)
+	return f, ipman.dropped
+}
+
+func TestFencerDropsAddressesAfterDeadline(t *testing.T) {
+	f, dropped := newTestFencer(t)
+
+	started := time.Now()
+	f.extend(started)
+
+	select {
+	case <-dropped:
+		if elapsed := time.Since(started); elapsed < f.timeout {
+			t.Errorf("addresses dropped after %s, before the deadline of %s", elapsed, f.timeout)
+		}
+	case <-time.After(5 * f.timeout):
+		t.Fatal("addresses not dropped after the deadline")
+	}
+}
+
+func TestFencerExtendMovesDeadline(t *testing.T) {
+	f, dropped := newTestFencer(t)
+
+	for i := 0; i < 5; i++ {
+		f.extend(time.Now())
+		select {
+		case <-dropped:
+			t.Fatal("addresses dropped although the deadline has been extended")
+		case <-time.After(f.timeout / 4):
+		}
+	}
+}
+
+func TestFencerLateRefreshDropsAddresses(t *testing.T) {
+	f, dropped := newTestFencer(t)
+
+	// the refresh has been started before the deadline, but only succeeded after it.
+	f.extend(time.Now().Add(-2 * f.timeout))
+
+	select {
+	case <-dropped:
+	case <-time.After(f.timeout / 2):
+		t.Fatal("addresses not dropped right away after a late refresh")
+	}
+}
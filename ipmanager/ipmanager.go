@@ -0,0 +1,49 @@
+package ipmanager
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/cybertec-postgresql/yaim/config"
+)
+
+// ErrUnsupportedManagerType is returned for an unsupported manager type
+var ErrUnsupportedManagerType = errors.New("given manager type not supported")
+
+// IPManager is the interface for registering the IP addresses of this node,
+// e.g. on a local interface or with the API of a cloud provider.
+type IPManager interface {
+	// SetIPSpecs passes the specs of all IP addresses in the pool, as retrieved from the DCS.
+	SetIPSpecs(specs map[string]config.IPSpec)
+	AddIP(ip string) error
+	DeleteIP(ip string) error
+	// CheckIP returns nil if the address is registered exactly as specified.
+	CheckIP(ip string) error
+	// GetAllIP returns all addresses registered by this node.
+	GetAllIP() ([]*net.IPNet, error)
+	DeleteAllIP()
+	// Watch notifies about changes of the registered addresses made by someone else, until ctx is done.
+	Watch(ctx context.Context) <-chan struct{}
+}
+
+// NewIPManager returns a new IPManager instance depending on the configuration
+func NewIPManager(conf *config.Shared) (IPManager, error) {
+	var m IPManager
+	var err error
+
+	switch conf.Get().HostingType {
+	case "basic":
+		m, err = NewIPManagerLocal(conf)
+	case "hetzner":
+		m, err = NewIPManagerHetzner(conf)
+	case "aws":
+		m, err = NewIPManagerAWS(conf)
+	case "bgp":
+		m, err = NewIPManagerBGP(conf)
+	default:
+		err = ErrUnsupportedManagerType
+	}
+
+	return m, err
+}
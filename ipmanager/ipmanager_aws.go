@@ -0,0 +1,221 @@
+package ipmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/yaim/config"
+)
+
+// IPManagerAWS moves addresses to the network interface (ENI) of this EC2 instance through the EC2 API,
+// in addition to registering them on the local interface like IPManagerLocal.
+// The addresses in the pool are assigned as secondary private IPs of the ENI.
+// If the spec of an address names an Elastic IP, it is associated with that secondary private IP,
+// so every Elastic IP follows its own private address. Elastic IPs are never added to the local interface,
+// as EC2 translates them to the private address they are associated with.
+type IPManagerAWS struct {
+	*IPManagerCloud
+	ec2                *ec2.Client
+	networkInterfaceID string
+}
+
+func NewIPManagerAWS(conf *config.Shared) (*IPManagerAWS, error) {
+	local, err := NewIPManagerLocal(conf)
+	if err != nil {
+		return nil, err
+	}
+	m := &IPManagerAWS{
+		networkInterfaceID: conf.Get().AwsNetworkInterfaceID,
+	}
+	m.IPManagerCloud = newIPManagerCloud(local, m)
+
+	ctx, cancel := m.context()
+	defer cancel()
+
+	var opts []func(*awsconfig.LoadOptions) error
+	if conf.Get().AwsAccessKeyID != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(conf.Get().AwsAccessKeyID, conf.Get().AwsSecretAccessKey, "")))
+	}
+	awsConf, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	metadata := imds.NewFromConfig(awsConf)
+
+	awsConf.Region = conf.Get().AwsRegion
+	if awsConf.Region == "" {
+		resp, err := metadata.GetRegion(ctx, &imds.GetRegionInput{})
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve the region from the instance metadata, set aws-region instead: %w", err)
+		}
+		awsConf.Region = resp.Region
+		log.Print("Retrieved the region from the instance metadata: ", awsConf.Region)
+	}
+	if m.networkInterfaceID == "" {
+		m.networkInterfaceID, err = metadataNetworkInterfaceID(ctx, metadata)
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve the network interface from the instance metadata, set aws-network-interface-id instead: %w", err)
+		}
+		log.Print("Retrieved the network interface from the instance metadata: ", m.networkInterfaceID)
+	}
+
+	endpoint := conf.Get().AwsEndpoint
+	m.ec2 = ec2.NewFromConfig(awsConf, func(o *ec2.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return m, nil
+}
+
+// getMetadata returns a single value from the instance metadata.
+func getMetadata(ctx context.Context, metadata *imds.Client, path string) (string, error) {
+	resp, err := metadata.GetMetadata(ctx, &imds.GetMetadataInput{Path: path})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Content.Close()
+	value, err := io.ReadAll(resp.Content)
+	return string(value), err
+}
+
+// metadataNetworkInterfaceID returns the ENI of the primary network interface of this instance.
+func metadataNetworkInterfaceID(ctx context.Context, metadata *imds.Client) (string, error) {
+	mac, err := getMetadata(ctx, metadata, "mac")
+	if err != nil {
+		return "", err
+	}
+	return getMetadata(ctx, metadata, "network/interfaces/macs/"+mac+"/interface-id")
+}
+
+// elasticIP returns the Elastic IP with the given public address.
+func (m *IPManagerAWS) elasticIP(ctx context.Context, ip string) (*types.Address, error) {
+	resp, err := m.ec2.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{
+		Filters: []types.Filter{{Name: aws.String("public-ip"), Values: []string{ip}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Addresses) == 0 {
+		return nil, errors.New("Elastic IP not found: " + ip)
+	}
+	return &resp.Addresses[0], nil
+}
+
+// isAssigned returns whether the private address is assigned to the ENI of this instance.
+func (m *IPManagerAWS) isAssigned(ctx context.Context, ip string) (bool, error) {
+	resp, err := m.ec2.DescribeNetworkInterfaces(ctx, &ec2.DescribeNetworkInterfacesInput{
+		NetworkInterfaceIds: []string{m.networkInterfaceID},
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(resp.NetworkInterfaces) == 0 {
+		return false, errors.New("network interface not found: " + m.networkInterfaceID)
+	}
+	for _, addr := range resp.NetworkInterfaces[0].PrivateIpAddresses {
+		if aws.ToString(addr.PrivateIpAddress) == ip {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isAssociated returns whether the Elastic IP is associated with the private address on the ENI of this instance.
+func (m *IPManagerAWS) isAssociated(eip *types.Address, ip string) bool {
+	return aws.ToString(eip.NetworkInterfaceId) == m.networkInterfaceID && aws.ToString(eip.PrivateIpAddress) == ip
+}
+
+func (m *IPManagerAWS) assign(ctx context.Context, ip string) error {
+	assigned, err := m.isAssigned(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if assigned {
+		log.Debug("Private IP: ", ip, " is already assigned to network interface: ", m.networkInterfaceID)
+	} else {
+		// the address is taken away from any other network interface in the subnet.
+		_, err = m.ec2.AssignPrivateIpAddresses(ctx, &ec2.AssignPrivateIpAddressesInput{
+			NetworkInterfaceId: aws.String(m.networkInterfaceID),
+			PrivateIpAddresses: []string{ip},
+			AllowReassignment:  aws.Bool(true),
+		})
+		if err != nil {
+			return err
+		}
+		log.Info("Assigned private IP: ", ip, " to network interface: ", m.networkInterfaceID)
+	}
+
+	public := m.spec(ip).ElasticIP
+	if public == "" {
+		return nil
+	}
+	eip, err := m.elasticIP(ctx, public)
+	if err != nil {
+		return err
+	}
+	if m.isAssociated(eip, ip) {
+		log.Debug("Elastic IP: ", public, " is already associated with private IP: ", ip)
+		return nil
+	}
+	// the Elastic IP is taken away from any other instance, but not from the other private addresses of this one.
+	_, err = m.ec2.AssociateAddress(ctx, &ec2.AssociateAddressInput{
+		AllocationId:       eip.AllocationId,
+		NetworkInterfaceId: aws.String(m.networkInterfaceID),
+		PrivateIpAddress:   aws.String(ip),
+		AllowReassociation: aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("Associated Elastic IP: ", public, " with private IP: ", ip, " on network interface: ", m.networkInterfaceID)
+	return nil
+}
+
+func (m *IPManagerAWS) unassign(ctx context.Context, ip string) error {
+	if public := m.spec(ip).ElasticIP; public != "" {
+		eip, err := m.elasticIP(ctx, public)
+		if err != nil {
+			return err
+		}
+		if !m.isAssociated(eip, ip) {
+			log.Debug("Elastic IP: ", public, " is not associated with private IP: ", ip)
+		} else {
+			_, err = m.ec2.DisassociateAddress(ctx, &ec2.DisassociateAddressInput{
+				AssociationId: eip.AssociationId,
+			})
+			if err != nil {
+				return err
+			}
+			log.Info("Disassociated Elastic IP: ", public, " from private IP: ", ip)
+		}
+	}
+
+	assigned, err := m.isAssigned(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if !assigned {
+		log.Debug("Private IP: ", ip, " is not assigned to network interface: ", m.networkInterfaceID)
+		return nil
+	}
+	_, err = m.ec2.UnassignPrivateIpAddresses(ctx, &ec2.UnassignPrivateIpAddressesInput{
+		NetworkInterfaceId: aws.String(m.networkInterfaceID),
+		PrivateIpAddresses: []string{ip},
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("Unassigned private IP: ", ip, " from network interface: ", m.networkInterfaceID)
+	return nil
+}
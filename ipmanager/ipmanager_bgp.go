@@ -0,0 +1,374 @@
+package ipmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	api "github.com/osrg/gobgp/v3/api"
+	bgplog "github.com/osrg/gobgp/v3/pkg/log"
+	"github.com/osrg/gobgp/v3/pkg/server"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/cybertec-postgresql/yaim/config"
+	"github.com/cybertec-postgresql/yaim/metrics"
+)
+
+// IPManagerBGP announces the addresses of this node as host routes to its BGP peers through an embedded BGP speaker.
+// Unless bgp-configure-address is disabled, the addresses are registered on the interface like IPManagerLocal as well,
+// usually on lo, so this node accepts the traffic that is routed to it.
+type IPManagerBGP struct {
+	*IPManagerLocal
+	server *server.BgpServer
+
+	mu sync.Mutex
+	// addresses that are currently announced, along with the uuid of their path.
+	announced map[string][]byte
+}
+
+var (
+	familyIPv4 = &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST}
+	familyIPv6 = &api.Family{Afi: api.Family_AFI_IP6, Safi: api.Family_SAFI_UNICAST}
+)
+
+func NewIPManagerBGP(conf *config.Shared) (*IPManagerBGP, error) {
+	local, err := NewIPManagerLocal(conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Get().BgpAsn <= 0 || conf.Get().BgpRouterID == "" {
+		return nil, errors.New("bgp-asn and bgp-router-id need to be set when using the bgp manager")
+	}
+	if len(conf.Get().BgpPeers) == 0 {
+		return nil, errors.New("bgp-peers needs to contain at least one peer when using the bgp manager")
+	}
+	// parse the communities right away, so invalid ones are reported during startup.
+	if _, err := parseCommunities(conf.Get().BgpCommunities); err != nil {
+		return nil, err
+	}
+
+	m := &IPManagerBGP{
+		IPManagerLocal: local,
+		server:         server.NewBgpServer(server.LoggerOption(&bgpLogger{})),
+		announced:      make(map[string][]byte),
+	}
+	go m.server.Serve()
+
+	ctx, cancel := m.context()
+	defer cancel()
+	err = m.server.StartBgp(ctx, &api.StartBgpRequest{
+		Global: &api.Global{
+			Asn:        uint32(conf.Get().BgpAsn),
+			RouterId:   conf.Get().BgpRouterID,
+			ListenPort: int32(conf.Get().BgpListenPort),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to start the BGP speaker: %w", err)
+	}
+	for _, p := range conf.Get().BgpPeers {
+		asn := p.Asn
+		if asn == 0 {
+			asn = conf.Get().BgpAsn
+		}
+		err = m.server.AddPeer(ctx, &api.AddPeerRequest{
+			Peer: &api.Peer{
+				Conf: &api.PeerConf{
+					NeighborAddress: p.Address,
+					PeerAsn:         uint32(asn),
+					AuthPassword:    conf.Get().BgpPassword,
+				},
+				Transport: &api.Transport{RemotePort: uint32(p.Port)},
+				// both families are offered to every peer, so IPv4 and IPv6 addresses can share a session.
+				AfiSafis: []*api.AfiSafi{
+					{Config: &api.AfiSafiConfig{Family: familyIPv4, Enabled: true}},
+					{Config: &api.AfiSafiConfig{Family: familyIPv6, Enabled: true}},
+				},
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to add BGP peer %s: %w", p.Address, err)
+		}
+		log.Print("Added BGP peer: ", p.Address, " with AS: ", asn)
+	}
+	return m, nil
+}
+
+// operations of the embedded BGP speaker only take longer than the TTL if it is stuck.
+func (m *IPManagerBGP) context() (context.Context, context.CancelFunc) {
+	return m.conf().RequestContext()
+}
+
+// parseCommunities converts communities like 65000:100 to their numeric value.
+func parseCommunities(communities []string) ([]uint32, error) {
+	values := []uint32{}
+	for _, c := range communities {
+		parts := strings.Split(c, ":")
+		if len(parts) != 2 {
+			return nil, errors.New("invalid BGP community, expected ASN:value: " + c)
+		}
+		asn, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return nil, errors.New("invalid BGP community, expected ASN:value: " + c)
+		}
+		value, err := strconv.ParseUint(parts[1], 10, 16)
+		if err != nil {
+			return nil, errors.New("invalid BGP community, expected ASN:value: " + c)
+		}
+		values = append(values, uint32(asn<<16|value))
+	}
+	return values, nil
+}
+
+// path builds the host route of the address, with the next hop and communities of the current configuration.
+func (m *IPManagerBGP) path(ip net.IP) (*api.Path, error) {
+	prefixLen, family, nextHop := uint32(32), familyIPv4, m.conf().BgpNextHop
+	if nextHop == "" {
+		// the speaker replaces an unspecified next hop with the local address of each session.
+		nextHop = "0.0.0.0"
+	}
+	if isIPv6(ip) {
+		prefixLen, family, nextHop = 128, familyIPv6, m.conf().BgpNextHop6
+		if nextHop == "" {
+			nextHop = "::"
+		}
+	}
+
+	nlri, err := anypb.New(&api.IPAddressPrefix{Prefix: ip.String(), PrefixLen: prefixLen})
+	if err != nil {
+		return nil, err
+	}
+	attrs := []proto.Message{&api.OriginAttribute{Origin: 0}} // IGP
+	if isIPv6(ip) {
+		attrs = append(attrs, &api.MpReachNLRIAttribute{Family: family, NextHops: []string{nextHop}, Nlris: []*anypb.Any{nlri}})
+	} else {
+		attrs = append(attrs, &api.NextHopAttribute{NextHop: nextHop})
+	}
+	communities, err := parseCommunities(m.conf().BgpCommunities)
+	if err != nil {
+		return nil, err
+	}
+	if len(communities) > 0 {
+		attrs = append(attrs, &api.CommunitiesAttribute{Communities: communities})
+	}
+
+	pattrs := []*anypb.Any{}
+	for _, a := range attrs {
+		pattr, err := anypb.New(a)
+		if err != nil {
+			return nil, err
+		}
+		pattrs = append(pattrs, pattr)
+	}
+	return &api.Path{Family: family, Nlri: nlri, Pattrs: pattrs}, nil
+}
+
+func (m *IPManagerBGP) announce(ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return errors.New("invalid IP address: " + ip)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.announced[parsed.String()]; ok {
+		log.Debug("IP address: ", ip, " is already announced")
+		return nil
+	}
+	path, err := m.path(parsed)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := m.context()
+	defer cancel()
+	resp, err := m.server.AddPath(ctx, &api.AddPathRequest{TableType: api.TableType_GLOBAL, Path: path})
+	if err != nil {
+		return err
+	}
+	m.announced[parsed.String()] = resp.Uuid
+	log.Info("Announced IP address: ", ip, " to BGP peers")
+	return nil
+}
+
+func (m *IPManagerBGP) withdraw(ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return errors.New("invalid IP address: " + ip)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	uuid, ok := m.announced[parsed.String()]
+	if !ok {
+		log.Debug("IP address: ", ip, " is not announced")
+		return nil
+	}
+	ctx, cancel := m.context()
+	defer cancel()
+	err := m.server.DeletePath(ctx, &api.DeletePathRequest{TableType: api.TableType_GLOBAL, Uuid: uuid})
+	if err != nil {
+		return err
+	}
+	delete(m.announced, parsed.String())
+	log.Info("Withdrew IP address: ", ip, " from BGP peers")
+	return nil
+}
+
+func (m *IPManagerBGP) isAnnounced(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.announced[parsed.String()]
+	return ok
+}
+
+// AddIP registers the address locally first, so this node accepts the traffic as soon as it is routed to it.
+func (m *IPManagerBGP) AddIP(ip string) (err error) {
+	if m.conf().BgpConfigureAddress {
+		err = m.IPManagerLocal.AddIP(ip)
+		if err != nil {
+			return err
+		}
+	} else {
+		defer func() { metrics.ObserveAddressOperation("add", err) }()
+	}
+	err = m.announce(ip)
+	if err != nil {
+		log.Error("Unable to announce IP: ", ip, " to BGP peers")
+		if m.conf().BgpConfigureAddress {
+			// the address will be unmarked, so another node needs to be able to take it over.
+			if deleteErr := m.IPManagerLocal.DeleteIP(ip); deleteErr != nil {
+				log.Error("Unable to delete IP: ", ip, " after failing to announce it:")
+				log.Error(deleteErr)
+			}
+		}
+	}
+	return err
+}
+
+// DeleteIP withdraws the route first, so no more traffic is routed to this node once the address is removed.
+func (m *IPManagerBGP) DeleteIP(ip string) (err error) {
+	if !m.conf().BgpConfigureAddress {
+		defer func() { metrics.ObserveAddressOperation("delete", err) }()
+	}
+	err = m.withdraw(ip)
+	if err != nil {
+		log.Error("Unable to withdraw IP: ", ip, " from BGP peers")
+		return err
+	}
+	if m.conf().BgpConfigureAddress {
+		return m.IPManagerLocal.DeleteIP(ip)
+	}
+	return nil
+}
+
+// CheckIP requires the address to be announced, and to be registered as specified unless bgp-configure-address is disabled.
+func (m *IPManagerBGP) CheckIP(ip string) error {
+	if !m.isAnnounced(ip) {
+		return errors.New("IP address is not announced.")
+	}
+	if m.conf().BgpConfigureAddress {
+		return m.IPManagerLocal.CheckIP(ip)
+	}
+	return nil
+}
+
+// GetAllIP returns the addresses that are registered locally or announced,
+// so addresses that are only left in one place are cleaned up as well.
+func (m *IPManagerBGP) GetAllIP() ([]*net.IPNet, error) {
+	var addrs []*net.IPNet
+	seen := map[string]bool{}
+	if m.conf().BgpConfigureAddress {
+		local, err := m.IPManagerLocal.GetAllIP()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range local {
+			seen[addr.IP.String()] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	m.mu.Lock()
+	announced := make([]string, 0, len(m.announced))
+	for ip := range m.announced {
+		announced = append(announced, ip)
+	}
+	m.mu.Unlock()
+	sort.Strings(announced)
+	for _, ip := range announced {
+		if seen[ip] {
+			continue
+		}
+		parsed := net.ParseIP(ip)
+		bits := 32
+		if isIPv6(parsed) {
+			bits = 128
+		}
+		addrs = append(addrs, &net.IPNet{IP: parsed, Mask: net.CIDRMask(bits, bits)})
+	}
+	return addrs, nil
+}
+
+func (m *IPManagerBGP) DeleteAllIP() {
+	m.mu.Lock()
+	announced := make([]string, 0, len(m.announced))
+	for ip := range m.announced {
+		announced = append(announced, ip)
+	}
+	m.mu.Unlock()
+	for _, ip := range announced {
+		err := m.withdraw(ip)
+		if !m.conf().BgpConfigureAddress {
+			metrics.ObserveAddressOperation("delete", err)
+		}
+		if err != nil {
+			log.Error("Failed to withdraw IP address: ", ip)
+			log.Error(err)
+		}
+	}
+	if m.conf().BgpConfigureAddress {
+		m.IPManagerLocal.DeleteAllIP()
+	}
+}
+
+// bgpLogger passes the log messages of the embedded BGP speaker on to the logger of yaim.
+type bgpLogger struct{}
+
+func (l *bgpLogger) Panic(msg string, fields bgplog.Fields) {
+	log.WithFields(log.Fields(fields)).Panic(msg)
+}
+
+func (l *bgpLogger) Fatal(msg string, fields bgplog.Fields) {
+	log.WithFields(log.Fields(fields)).Fatal(msg)
+}
+
+func (l *bgpLogger) Error(msg string, fields bgplog.Fields) {
+	log.WithFields(log.Fields(fields)).Error(msg)
+}
+
+func (l *bgpLogger) Warn(msg string, fields bgplog.Fields) {
+	log.WithFields(log.Fields(fields)).Warn(msg)
+}
+
+func (l *bgpLogger) Info(msg string, fields bgplog.Fields) {
+	log.WithFields(log.Fields(fields)).Info(msg)
+}
+
+func (l *bgpLogger) Debug(msg string, fields bgplog.Fields) {
+	log.WithFields(log.Fields(fields)).Debug(msg)
+}
+
+// the log level is set through log-level for all of yaim.
+func (l *bgpLogger) SetLevel(level bgplog.LogLevel) {}
+
+func (l *bgpLogger) GetLevel() bgplog.LogLevel {
+	return bgplog.LogLevel(log.GetLevel())
+}
@@ -0,0 +1,54 @@
+package ipmanager
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cloudProvider moves addresses between the nodes through the API of a cloud provider.
+type cloudProvider interface {
+	// assign moves the address to this node, taking it away from any other node.
+	assign(ctx context.Context, ip string) error
+	// unassign releases the address, but only if it is still assigned to this node,
+	// so it doesn't take it away from a node that has taken it over in the meantime.
+	unassign(ctx context.Context, ip string) error
+}
+
+// IPManagerCloud assigns addresses to this node through a cloud provider before registering them on the local interface like IPManagerLocal.
+// Addresses are not unassigned after they have been removed locally, as their mark might have been taken over
+// by another node already, which would lose the address again. Assigning it to the next node moves it anyway.
+type IPManagerCloud struct {
+	*IPManagerLocal
+	provider cloudProvider
+}
+
+func newIPManagerCloud(local *IPManagerLocal, provider cloudProvider) *IPManagerCloud {
+	return &IPManagerCloud{IPManagerLocal: local, provider: provider}
+}
+
+func (m *IPManagerCloud) context() (context.Context, context.CancelFunc) {
+	return m.conf().RequestContext()
+}
+
+func (m *IPManagerCloud) AddIP(ip string) error {
+	ctx, cancel := m.context()
+	err := m.provider.assign(ctx, ip)
+	cancel()
+	if err != nil {
+		log.Error("Unable to assign IP: ", ip, " to this node")
+		return err
+	}
+	err = m.IPManagerLocal.AddIP(ip)
+	if err != nil {
+		// the address will be unmarked, so another node needs to be able to take it over.
+		// Until then, we still hold the mark, so nobody else can have assigned the address in the meantime.
+		ctx, cancel := m.context()
+		defer cancel()
+		if unassignErr := m.provider.unassign(ctx, ip); unassignErr != nil {
+			log.Error("Unable to unassign IP: ", ip, " after failing to add it locally:")
+			log.Error(unassignErr)
+		}
+	}
+	return err
+}
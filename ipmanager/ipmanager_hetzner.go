@@ -0,0 +1,246 @@
+package ipmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/cybertec-postgresql/yaim/config"
+)
+
+// IPManagerHetzner assigns floating IPs to this server through the Hetzner Cloud API,
+// in addition to registering them on the local interface like IPManagerLocal.
+type IPManagerHetzner struct {
+	*IPManagerCloud
+	client   *http.Client
+	token    string
+	serverID int
+}
+
+type hetznerFloatingIP struct {
+	ID     int    `json:"id"`
+	IP     string `json:"ip"` // IPv6 floating IPs are whole networks, e.g. 2001:db8::/64
+	Server *int   `json:"server"`
+}
+
+type hetznerAction struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"` // running, success or error
+	Error  *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type hetznerError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func NewIPManagerHetzner(conf *config.Shared) (*IPManagerHetzner, error) {
+	local, err := NewIPManagerLocal(conf)
+	if err != nil {
+		return nil, err
+	}
+	m := &IPManagerHetzner{
+		client:   &http.Client{Timeout: conf.Get().RequestTimeout()},
+		token:    conf.Get().HetznerToken,
+		serverID: conf.Get().HetznerServerID,
+	}
+	m.IPManagerCloud = newIPManagerCloud(local, m)
+
+	if m.token == "" && conf.Get().HetznerTokenFile != "" {
+		content, err := ioutil.ReadFile(conf.Get().HetznerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read hetzner-token-file: %w", err)
+		}
+		m.token = strings.TrimSpace(string(content))
+	}
+	if m.token == "" {
+		return nil, errors.New("hetzner-token or hetzner-token-file needs to be set when using the hetzner manager")
+	}
+
+	if m.serverID == 0 {
+		m.serverID, err = m.metadataServerID()
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve the id of this server from the metadata service, set hetzner-server-id instead: %w", err)
+		}
+		log.Print("Retrieved the id of this server from the metadata service: ", m.serverID)
+	}
+	return m, nil
+}
+
+func (m *IPManagerHetzner) metadataServerID() (int, error) {
+	resp, err := m.client.Get(m.conf().HetznerMetadataUrl + "/instance-id")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(body)))
+}
+
+// request sends a request to the Hetzner Cloud API and decodes the response into result, unless it is nil.
+func (m *IPManagerHetzner) request(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(content)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(m.conf().HetznerApiUrl, "/")+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr hetznerError
+		if json.Unmarshal(content, &apiErr) == nil && apiErr.Error.Code != "" {
+			return fmt.Errorf("hetzner api: %s %s: %s (%s)", method, path, apiErr.Error.Message, apiErr.Error.Code)
+		}
+		return fmt.Errorf("hetzner api: %s %s: unexpected status code: %d", method, path, resp.StatusCode)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(content, result)
+}
+
+// floatingIP finds the floating IP that contains the address.
+func (m *IPManagerHetzner) floatingIP(ctx context.Context, ip string) (*hetznerFloatingIP, error) {
+	queried := net.ParseIP(ip)
+	if queried == nil {
+		return nil, errors.New("invalid IP address: " + ip)
+	}
+	page := 1
+	for page != 0 {
+		var resp struct {
+			FloatingIPs []hetznerFloatingIP `json:"floating_ips"`
+			Meta        struct {
+				Pagination struct {
+					NextPage *int `json:"next_page"`
+				} `json:"pagination"`
+			} `json:"meta"`
+		}
+		err := m.request(ctx, http.MethodGet, fmt.Sprintf("/floating_ips?page=%d&per_page=50", page), nil, &resp)
+		if err != nil {
+			return nil, err
+		}
+		for i, f := range resp.FloatingIPs {
+			if _, network, err := net.ParseCIDR(f.IP); err == nil {
+				if network.Contains(queried) {
+					return &resp.FloatingIPs[i], nil
+				}
+			} else if queried.Equal(net.ParseIP(f.IP)) {
+				return &resp.FloatingIPs[i], nil
+			}
+		}
+		page = 0
+		if resp.Meta.Pagination.NextPage != nil {
+			page = *resp.Meta.Pagination.NextPage
+		}
+	}
+	return nil, errors.New("no floating IP found for address: " + ip)
+}
+
+// action triggers an action on a floating IP and waits for it to finish.
+func (m *IPManagerHetzner) action(ctx context.Context, f *hetznerFloatingIP, name string, body interface{}) error {
+	var resp struct {
+		Action hetznerAction `json:"action"`
+	}
+	err := m.request(ctx, http.MethodPost, fmt.Sprintf("/floating_ips/%d/actions/%s", f.ID, name), body, &resp)
+	if err != nil {
+		return err
+	}
+	action := resp.Action
+	for action.Status == "running" {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("hetzner api: action %s of floating IP %s didn't finish: %w", name, f.IP, ctx.Err())
+		case <-time.After(time.Duration(m.conf().RetryAfter) * time.Millisecond):
+		}
+		var polled struct {
+			Action hetznerAction `json:"action"`
+		}
+		err := m.request(ctx, http.MethodGet, fmt.Sprintf("/actions/%d", action.ID), nil, &polled)
+		if err != nil {
+			return err
+		}
+		action = polled.Action
+	}
+	if action.Status != "success" {
+		if action.Error != nil {
+			return fmt.Errorf("hetzner api: action %s of floating IP %s failed: %s (%s)", name, f.IP, action.Error.Message, action.Error.Code)
+		}
+		return fmt.Errorf("hetzner api: action %s of floating IP %s failed with status: %s", name, f.IP, action.Status)
+	}
+	return nil
+}
+
+func (m *IPManagerHetzner) assign(ctx context.Context, ip string) error {
+	f, err := m.floatingIP(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if f.Server != nil && *f.Server == m.serverID {
+		log.Debug("Floating IP: ", f.IP, " is already assigned to this server")
+		return nil
+	}
+	err = m.action(ctx, f, "assign", map[string]int{"server": m.serverID})
+	if err != nil {
+		return err
+	}
+	log.Info("Assigned floating IP: ", f.IP, " to server: ", m.serverID)
+	return nil
+}
+
+func (m *IPManagerHetzner) unassign(ctx context.Context, ip string) error {
+	f, err := m.floatingIP(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if f.Server == nil || *f.Server != m.serverID {
+		log.Debug("Floating IP: ", f.IP, " is not assigned to this server")
+		return nil
+	}
+	err = m.action(ctx, f, "unassign", nil)
+	if err != nil {
+		return err
+	}
+	log.Info("Unassigned floating IP: ", f.IP, " from server: ", m.serverID)
+	return nil
+}
@@ -1,15 +1,26 @@
 package ipmanager
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cybertec-postgresql/yaim/config"
+	"github.com/cybertec-postgresql/yaim/metrics"
+	"github.com/cybertec-postgresql/yaim/notify"
 	"github.com/mdlayher/arp"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -17,96 +28,312 @@ const (
 	arpReplyOp   = 2
 )
 
+const (
+	// ifaProto is the IFA_PROTO attribute of addresses (Linux 5.18 and later), which tells who has added an address.
+	ifaProto = 11
+	// addrProtocol tags the IPv6 addresses added by yaim, shown as "proto 0x59" by ip addr.
+	addrProtocol = 0x59
+)
+
 var (
 	ethernetBroadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	ethernetZero      = net.HardwareAddr{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 )
 
+// AddressConflictError is returned by AddIP if another host on the segment still uses the address.
+type AddressConflictError struct {
+	IP           net.IP
+	HardwareAddr net.HardwareAddr
+}
+
+func (e *AddressConflictError) Error() string {
+	return fmt.Sprintf("IP address %s is already in use by %s", e.IP, e.HardwareAddr)
+}
+
 type IPManagerLocal struct {
-	conf      *config.Config
-	code      int
-	result    string
-	addresses []string
-	label     string
+	shared *config.Shared
+	code   int
+	result string
+
+	mu sync.Mutex
+	// addresses that we have registered ourselves, to tell them apart from changes made by someone else.
+	// Linux doesn't support labels for IPv6 addresses, so this is the only way to find our IPv6 addresses on kernels without IFA_PROTO.
+	addresses map[string]bool
+	// specs of the IP addresses in the pool, as retrieved from the DCS.
+	specs map[string]config.IPSpec
+	// all interfaces that addresses might have been registered on, including those of specs that have been removed since.
+	interfaces map[string]bool
+}
+
+// linkAddr is an address registered by yaim, along with the interface it is registered on.
+type linkAddr struct {
+	link netlink.Link
+	addr netlink.Addr
+}
+
+func (ipManLocal *IPManagerLocal) conf() *config.Config {
+	return ipManLocal.shared.Get()
 }
 
-func NewIPManagerLocal(conf *config.Config) (IPManagerLocal, error) {
+func NewIPManagerLocal(conf *config.Shared) (*IPManagerLocal, error) {
 	var ipManLocal IPManagerLocal
-	ipManLocal.conf = conf
-	ipManLocal.label = conf.Iface + ":" + conf.Label
-	if len(ipManLocal.label) >= 16 {
-		log.Fatal("The label to be used when registering ip addresses is longer than 16 characters: ", ipManLocal.label)
+	ipManLocal.shared = conf
+	label := conf.Get().Iface + ":" + conf.Get().Label
+	if len(label) >= 16 {
+		log.Fatal("The label to be used when registering ip addresses is longer than 16 characters: ", label)
+	}
+	ipManLocal.addresses = make(map[string]bool)
+	ipManLocal.specs = make(map[string]config.IPSpec)
+	ipManLocal.interfaces = map[string]bool{conf.Get().Iface: true}
+	return &ipManLocal, nil
+}
+
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil
+}
+
+// SetIPSpecs updates the specs of the IP addresses in the pool.
+// Addresses without a spec are registered according to the global configuration.
+func (ipManLocal *IPManagerLocal) SetIPSpecs(specs map[string]config.IPSpec) {
+	ipManLocal.mu.Lock()
+	defer ipManLocal.mu.Unlock()
+	ipManLocal.specs = specs
+	for _, spec := range specs {
+		if spec.Interface != "" {
+			ipManLocal.interfaces[spec.Interface] = true
+		}
+	}
+}
+
+func (ipManLocal *IPManagerLocal) spec(ip string) config.IPSpec {
+	ipManLocal.mu.Lock()
+	defer ipManLocal.mu.Unlock()
+	return ipManLocal.specs[ip]
+}
+
+func (ipManLocal *IPManagerLocal) managedInterfaces() []string {
+	ipManLocal.mu.Lock()
+	defer ipManLocal.mu.Unlock()
+	var ifaces []string
+	for iface := range ipManLocal.interfaces {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Strings(ifaces)
+	return ifaces
+}
+
+func (ipManLocal *IPManagerLocal) ifaceName(spec config.IPSpec) string {
+	if spec.Interface != "" {
+		return spec.Interface
+	}
+	return ipManLocal.conf().Iface
+}
+
+func (ipManLocal *IPManagerLocal) parseAddr(ip string, spec config.IPSpec) (*netlink.Addr, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, errors.New("invalid IP address: " + ip)
+	}
+	mask := ipManLocal.conf().Mask
+	if isIPv6(parsed) {
+		mask = ipManLocal.conf().Mask6
+	}
+	if spec.Prefix > 0 {
+		mask = spec.Prefix
+	}
+	label := ipManLocal.ifaceName(spec) + ":" + ipManLocal.conf().Label + spec.Label
+	if len(label) >= 16 {
+		return nil, errors.New("The label to be used when registering ip address " + ip + " is longer than 16 characters: " + label)
+	}
+	addr, err := netlink.ParseAddr(ip + "/" + fmt.Sprint(mask) + " " + label)
+	if err != nil {
+		return nil, err
+	}
+	if isIPv6(parsed) {
+		addr.Label = ""
+		// Duplicate address detection would keep the address from being used for a while after adding it.
+		// The mark in the DCS makes sure that no other yaim uses the address.
+		addr.Flags = unix.IFA_F_NODAD
+	}
+	return addr, nil
+}
+
+// track is called before an address is added or deleted, so the resulting netlink update is never taken for someone else's change.
+func (ipManLocal *IPManagerLocal) track(ip net.IP, registered bool) {
+	ipManLocal.mu.Lock()
+	defer ipManLocal.mu.Unlock()
+	if registered {
+		ipManLocal.addresses[ip.String()] = true
+	} else {
+		delete(ipManLocal.addresses, ip.String())
+	}
+}
+
+func (ipManLocal *IPManagerLocal) isTracked(ip net.IP) bool {
+	ipManLocal.mu.Lock()
+	defer ipManLocal.mu.Unlock()
+	return ipManLocal.addresses[ip.String()]
+}
+
+// isManaged returns true for all addresses that have been registered by yaim.
+// The labels of IPv4 addresses start with the interface and the configured label, followed by the label of their spec.
+// IPv6 addresses are either tracked or tagged with our address protocol, which finds those left behind by a previous yaim.
+func (ipManLocal *IPManagerLocal) isManaged(iface string, addr netlink.Addr, tagged map[string]bool) bool {
+	if isIPv6(addr.IP) {
+		return ipManLocal.isTracked(addr.IP) || tagged[addr.IP.String()]
 	}
-	return ipManLocal, nil
+	return strings.HasPrefix(addr.Label, iface+":"+ipManLocal.conf().Label)
 }
 
-func (ipManLocal *IPManagerLocal) AddIP(ip string) error {
-	iface, iface_err := netlink.LinkByName(ipManLocal.conf.Iface)
+// managedAddrs returns the addresses registered by yaim on all interfaces that are in use.
+// Only a failure to list the addresses of the configured interface is returned as an error,
+// as interfaces given in specs might not exist on every node.
+func (ipManLocal *IPManagerLocal) managedAddrs() ([]linkAddr, error) {
+	var managed []linkAddr
+	for _, name := range ipManLocal.managedInterfaces() {
+		iface, iface_err := netlink.LinkByName(name)
+		if iface_err != nil {
+			if name == ipManLocal.conf().Iface {
+				log.Error("Unable to obtain interface by name: ", iface_err)
+				return nil, iface_err
+			}
+			log.Error("Unable to obtain interface by name: ", name, ": ", iface_err)
+			continue
+		}
+		addrs, addrs_err := netlink.AddrList(iface, netlink.FAMILY_ALL)
+		if addrs_err != nil {
+			if name == ipManLocal.conf().Iface {
+				log.Error("Unable to retrieve list of addresses: ", addrs_err)
+				return nil, addrs_err
+			}
+			log.Error("Unable to retrieve list of addresses of interface: ", name, ": ", addrs_err)
+			continue
+		}
+		tagged, tagged_err := taggedAddrs(iface)
+		if tagged_err != nil {
+			log.Error("Unable to retrieve list of tagged IPv6 addresses of interface: ", name, ": ", tagged_err)
+		}
+		for _, addr := range addrs {
+			if ipManLocal.isManaged(name, addr, tagged) {
+				managed = append(managed, linkAddr{link: iface, addr: addr})
+			}
+		}
+	}
+	return managed, nil
+}
+
+func (ipManLocal *IPManagerLocal) AddIP(ip string) (err error) {
+	defer func() { metrics.ObserveAddressOperation("add", err) }()
+	spec := ipManLocal.spec(ip)
+	ifaceName := ipManLocal.ifaceName(spec)
+	iface, iface_err := netlink.LinkByName(ifaceName)
 	if iface_err != nil {
 		log.Error("Unable to obtain interface by name: ", iface_err)
 		return iface_err
 	}
-	addr, addr_err := netlink.ParseAddr(ip + "/" + fmt.Sprint(ipManLocal.conf.Mask) + " " + ipManLocal.label)
+	addr, addr_err := ipManLocal.parseAddr(ip, spec)
 	if addr_err != nil {
 		log.Error("Unable to parse IP address: ", addr_err)
 		return addr_err
 	}
-	err := netlink.AddrAdd(iface, addr)
-	if err == nil {
-		log.Info("Registered IP address: ", addr)
-		// We can only send gratuitous ARP requests for non-local interfaces.
-		if ipManLocal.conf.Iface != "lo" {
-			err := ipManLocal.arpSendGratuitous(iface, *addr)
-			if err == nil {
-				log.Info("Sent gratuitous arp request and reply after adding address")
+	// We can only probe for other users of the address on non-local interfaces.
+	if ipManLocal.conf().ArpProbe && ifaceName != "lo" && !isIPv6(addr.IP) {
+		err := ipManLocal.arpProbe(iface, addr.IP)
+		if err != nil {
+			return err
+		}
+	}
+	tracked := ipManLocal.isTracked(addr.IP)
+	ipManLocal.track(addr.IP, true)
+	err = addrAdd(iface, addr)
+	if err != nil {
+		ipManLocal.track(addr.IP, tracked)
+	} else {
+		log.Info("Registered IP address: ", addr, " on interface: ", ifaceName)
+		// We can only send gratuitous ARP requests or unsolicited neighbor advertisements for non-local interfaces.
+		if ifaceName != "lo" && spec.SendGarp() {
+			if isIPv6(addr.IP) {
+				err := ipManLocal.ndpSendUnsolicited(iface, *addr)
+				if err == nil {
+					log.Info("Sent unsolicited neighbor advertisement after adding address")
+				} else {
+					metrics.GarpFailures.Inc()
+					log.Error(err)
+				}
 			} else {
-				// For now we'll do nothing besides logging the error.
-				// If we're unable to send ARP requests on our own accord,
-				// the OS might still do that for us when the ARP cache on neighbours runs out eventually.
-				log.Error(err)
+				err := ipManLocal.arpSendGratuitous(iface, *addr)
+				if err == nil {
+					log.Info("Sent gratuitous arp request and reply after adding address")
+				} else {
+					// For now we'll do nothing besides logging the error.
+					// If we're unable to send ARP requests on our own accord,
+					// the OS might still do that for us when the ARP cache on neighbours runs out eventually.
+					metrics.GarpFailures.Inc()
+					log.Error(err)
+				}
 			}
 		}
 	}
 	return err
 }
 
-func (ipManLocal *IPManagerLocal) DeleteIP(ip string) error {
-	iface, iface_err := netlink.LinkByName(ipManLocal.conf.Iface)
-	if iface_err != nil {
-		log.Error("Unable to obtain interface by name: ", iface_err)
-		return iface_err
+// DeleteIP removes the address from whichever interface it has been registered on,
+// so it can still be removed after its spec has changed.
+func (ipManLocal *IPManagerLocal) DeleteIP(ip string) (err error) {
+	defer func() { metrics.ObserveAddressOperation("delete", err) }()
+	queried := net.ParseIP(ip)
+	if queried == nil {
+		log.Error("Unable to parse IP address: ", ip)
+		return errors.New("invalid IP address: " + ip)
 	}
-	addr, addr_err := netlink.ParseAddr(ip + "/" + fmt.Sprint(ipManLocal.conf.Mask) + " " + ipManLocal.label)
-	if addr_err != nil {
-		log.Error("Unable to parse IP address: ", addr_err)
-		return addr_err
+	managed, err := ipManLocal.managedAddrs()
+	if err != nil {
+		return err
 	}
-	err := netlink.AddrDel(iface, addr)
-	if err == nil {
-		log.Info("Deregistered IP address: ", addr)
+	for _, m := range managed {
+		if !m.addr.IP.Equal(queried) {
+			continue
+		}
+		ipManLocal.track(m.addr.IP, false)
+		err = netlink.AddrDel(m.link, &m.addr)
+		if err != nil {
+			ipManLocal.track(m.addr.IP, true)
+			return err
+		}
+		log.Info("Deregistered IP address: ", m.addr, " from interface: ", m.link.Attrs().Name)
+		return nil
 	}
-	return err
+	return errors.New("IP address could not be found.")
 }
 
+// CheckIP returns nil if the address is registered exactly as specified, i.e. on the right interface, with the right prefix and label.
 func (ipManLocal *IPManagerLocal) CheckIP(ip string) error {
-	iface, iface_err := netlink.LinkByName(ipManLocal.conf.Iface)
+	spec := ipManLocal.spec(ip)
+	iface, iface_err := netlink.LinkByName(ipManLocal.ifaceName(spec))
 	if iface_err != nil {
 		log.Error("Unable to obtain interface by name: ", iface_err)
 		return iface_err
 	}
-	addrs, addrs_err := netlink.AddrList(iface, netlink.FAMILY_V4)
+	queried, addr_err := ipManLocal.parseAddr(ip, spec)
+	if addr_err != nil {
+		log.Error("Unable to parse IP address: ", addr_err)
+		return addr_err
+	}
+	addrs, addrs_err := netlink.AddrList(iface, netlink.FAMILY_ALL)
 	if addrs_err != nil {
 		log.Error("Unable to retrieve list of addresses: ", addrs_err)
 		return addrs_err
 	}
 	for _, addr := range addrs {
-		if addr.Label != ipManLocal.label {
+		// IPv6 addresses don't have a label, but the one we're looking for might have been registered by someone else.
+		if !isIPv6(addr.IP) && addr.Label != queried.Label {
 			continue
 		}
-		if addr.IPNet.String() == ip+"/"+fmt.Sprint(ipManLocal.conf.Mask) {
+		if addr.IPNet.String() == queried.IPNet.String() {
 			log.Debug("configured address matches queried address")
 			return nil
 		} else {
-			log.Debug("configured address " + addr.IPNet.String() + " doesn't match queried address " + ip + "/" + fmt.Sprint(ipManLocal.conf.Mask))
+			log.Debug("configured address " + addr.IPNet.String() + " doesn't match queried address " + queried.IPNet.String())
 		}
 	}
 	return errors.New("IP address could not be found.")
@@ -114,60 +341,257 @@ func (ipManLocal *IPManagerLocal) CheckIP(ip string) error {
 
 func (ipManLocal *IPManagerLocal) GetAllIP() ([]*net.IPNet, error) {
 	var filteredAddrs []*net.IPNet
-	iface, iface_err := netlink.LinkByName(ipManLocal.conf.Iface)
-	if iface_err != nil {
-		log.Error("Unable to obtain interface by name: ", iface_err)
-		return nil, iface_err
-	}
-	addrs, addrs_err := netlink.AddrList(iface, netlink.FAMILY_V4)
-	if addrs_err != nil {
-		log.Error("Unable to retrieve list of addresses: ", addrs_err)
-		return nil, addrs_err
+	managed, err := ipManLocal.managedAddrs()
+	if err != nil {
+		return nil, err
 	}
-	for _, addr := range addrs {
-		if addr.Label == ipManLocal.label {
-			filteredAddrs = append(filteredAddrs, addr.IPNet)
-		}
+	for _, m := range managed {
+		filteredAddrs = append(filteredAddrs, m.addr.IPNet)
 	}
 	return filteredAddrs, nil
 }
 
 func (ipManLocal *IPManagerLocal) DeleteAllIP() {
-	ips, err := ipManLocal.GetAllIP()
+	managed, err := ipManLocal.managedAddrs()
 	if err != nil {
 		log.Error("Unable to get all registered addresses for deletion")
 		log.Error(err)
 		return
 	}
-	if len(ips) == 0 {
-		//nothing to delete, apparently
-		return
+	for _, m := range managed {
+		addr := m.addr
+		ipManLocal.track(addr.IP, false)
+		err := netlink.AddrDel(m.link, &addr)
+		metrics.ObserveAddressOperation("delete", err)
+		if err != nil {
+			ipManLocal.track(addr.IP, true)
+			log.Error("Failed to delete IP address: ", addr)
+			log.Error(err)
+		} else {
+			log.Info("Deregistered IP address: ", addr, " from interface: ", m.link.Attrs().Name)
+		}
 	}
-	iface, iface_err := netlink.LinkByName(ipManLocal.conf.Iface)
-	if iface_err != nil {
-		log.Error("Unable to obtain interface by name: ")
-		log.Error(iface_err)
-		return
+}
+
+// Watch notifies about changes of the addresses on the managed interfaces made by someone else, until ctx is done,
+// e.g. an admin running ip addr flush, or NetworkManager resetting the interface.
+// Notifications are coalesced, so a receiver that is busy will only see one of them.
+func (ipManLocal *IPManagerLocal) Watch(ctx context.Context) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		for {
+			updates := make(chan netlink.AddrUpdate)
+			err := netlink.AddrSubscribeWithOptions(updates, ctx.Done(), netlink.AddrSubscribeOptions{
+				ErrorCallback: func(err error) {
+					if ctx.Err() == nil {
+						log.Error("Error while watching addresses:")
+						log.Error(err)
+					}
+				},
+			})
+			if err != nil {
+				log.Error("Unable to watch addresses:")
+				log.Error(err)
+			} else {
+				for update := range updates {
+					if ipManLocal.isForeignChange(update) {
+						notify.Send(changes)
+					}
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			//changes might have been missed while the subscription was broken.
+			notify.Send(changes)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(ipManLocal.conf().RetryAfter) * time.Millisecond):
+			}
+		}
+	}()
+	return changes
+}
+
+// isForeignChange returns true if an address registered by yaim has been removed by someone else,
+// or if someone else has registered an address that looks like one of ours on a managed interface.
+func (ipManLocal *IPManagerLocal) isForeignChange(update netlink.AddrUpdate) bool {
+	link, err := netlink.LinkByIndex(update.LinkIndex)
+	if err != nil {
+		// the interface is gone already, along with its addresses.
+		log.Debug("Unable to obtain interface of address update: ", err)
+		return !update.NewAddr && ipManLocal.isTracked(update.LinkAddress.IP)
+	}
+	name := link.Attrs().Name
+	managed := false
+	for _, iface := range ipManLocal.managedInterfaces() {
+		managed = managed || iface == name
 	}
-	for _, ip := range ips {
-		addr, addr_err := netlink.ParseAddr(ip.IP.String() + "/" + fmt.Sprint(ipManLocal.conf.Mask) + " " + ipManLocal.label)
-		if addr_err != nil {
-			log.Error("Unable to parse IP address: ", ip.IP.String(), "/", fmt.Sprint(ipManLocal.conf.Mask))
-			log.Error(addr_err)
+	if !managed {
+		return false
+	}
+
+	if !update.NewAddr {
+		if !ipManLocal.isTracked(update.LinkAddress.IP) {
+			return false
+		}
+		log.Warn("IP address: ", update.LinkAddress.String(), " was removed from interface: ", name, " by someone else")
+		metrics.ExternalAddressChanges.WithLabelValues("removed").Inc()
+		return true
+	}
+
+	if ipManLocal.isTracked(update.LinkAddress.IP) {
+		return false
+	}
+	// the update doesn't contain the label or the protocol, which tell our addresses apart.
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		log.Debug("Unable to retrieve list of addresses of interface: ", name, ": ", err)
+		return false
+	}
+	tagged, err := taggedAddrs(link)
+	if err != nil {
+		log.Debug("Unable to retrieve list of tagged IPv6 addresses of interface: ", name, ": ", err)
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(update.LinkAddress.IP) && ipManLocal.isManaged(name, addr, tagged) {
+			log.Warn("IP address: ", addr, " was registered on interface: ", name, " by someone else")
+			metrics.ExternalAddressChanges.WithLabelValues("added").Inc()
+			return true
+		}
+	}
+	return false
+}
+
+// addrAdd adds the address to the interface, tagging IPv6 addresses with our address protocol.
+// The netlink package doesn't support IFA_PROTO, so the request is built here; kernels that don't know the attribute ignore it.
+func addrAdd(link netlink.Link, addr *netlink.Addr) error {
+	if !isIPv6(addr.IP) {
+		return netlink.AddrAdd(link, addr)
+	}
+	req := nl.NewNetlinkRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+	msg := nl.NewIfAddrmsg(unix.AF_INET6)
+	msg.Index = uint32(link.Attrs().Index)
+	msg.Scope = uint8(addr.Scope)
+	prefixlen, _ := addr.Mask.Size()
+	msg.Prefixlen = uint8(prefixlen)
+	msg.Flags = uint8(addr.Flags)
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(unix.IFA_LOCAL, addr.IP.To16()))
+	req.AddData(nl.NewRtAttr(unix.IFA_ADDRESS, addr.IP.To16()))
+	flags := make([]byte, 4)
+	nl.NativeEndian().PutUint32(flags, uint32(addr.Flags))
+	req.AddData(nl.NewRtAttr(unix.IFA_FLAGS, flags))
+	req.AddData(nl.NewRtAttr(ifaProto, []byte{addrProtocol}))
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// taggedAddrs returns the IPv6 addresses of the interface that are tagged with our address protocol.
+func taggedAddrs(link netlink.Link) (map[string]bool, error) {
+	tagged := make(map[string]bool)
+	req := nl.NewNetlinkRequest(unix.RTM_GETADDR, unix.NLM_F_DUMP)
+	req.AddData(nl.NewIfAddrmsg(unix.AF_INET6))
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWADDR)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		msg := nl.DeserializeIfAddrmsg(m)
+		if msg.Family != unix.AF_INET6 || int(msg.Index) != link.Attrs().Index {
 			continue
 		}
-		err := netlink.AddrDel(iface, addr)
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
 		if err != nil {
-			log.Error("Failed to delete IP address: ", addr)
-			log.Error(err)
-		} else {
-			log.Info("Deregistered IP address: ", addr)
+			return nil, err
+		}
+		var ip net.IP
+		proto := -1
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case unix.IFA_ADDRESS:
+				ip = net.IP(attr.Value)
+			case ifaProto:
+				if len(attr.Value) > 0 {
+					proto = int(attr.Value[0])
+				}
+			}
+		}
+		if ip != nil && proto == addrProtocol {
+			tagged[ip.String()] = true
+		}
+	}
+	return tagged, nil
+}
+
+// arpProbe implements the probing of RFC 5227 (IPv4 Address Conflict Detection).
+// Returns an AddressConflictError if any other host claims to use the address.
+func (ipManLocal *IPManagerLocal) arpProbe(iface netlink.Link, ip net.IP) error {
+	interf, err := net.InterfaceByIndex(iface.Attrs().Index)
+	if err != nil {
+		return err
+	}
+	arpClient, err := arp.Dial(interf)
+	if err != nil {
+		log.Printf("Problems with producing the arp client: %s", err)
+		return err
+	}
+	defer arpClient.Close()
+
+	/* RFC 5227 specifies (in section 2.1.1) that the probe is an ARP request with
+	* an all-zero sender IP address, so the ARP caches of our neighbours are not polluted,
+	* and an all-zero target hardware address.
+	 */
+	probePackage, err := arp.NewPacket(
+		arpRequestOp,
+		iface.Attrs().HardwareAddr,
+		net.IPv4zero,
+		ethernetZero,
+		ip,
+	)
+	if err != nil {
+		log.Printf("Arp probe package is malformed: %s", err)
+		return err
+	}
+
+	for i := 0; i < ipManLocal.conf().ArpProbeNum; i++ {
+		err := arpClient.WriteTo(probePackage, ethernetBroadcast)
+		if err != nil {
+			log.Printf("Couldn't write to the arpClient: %s", err)
+			return err
+		}
+		log.Debug("Sent arp probe for IP address: ", ip)
+
+		err = arpClient.SetReadDeadline(time.Now().Add(time.Duration(ipManLocal.conf().ArpProbeWait) * time.Millisecond))
+		if err != nil {
+			return err
+		}
+		for {
+			pkt, _, err := arpClient.Read()
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return err
+			}
+			if bytes.Equal(pkt.SenderHardwareAddr, iface.Attrs().HardwareAddr) {
+				continue
+			}
+			// Any host using the address will reply to our probe or announce it by itself,
+			// any host probing for the address at the same time will send a probe just like ours.
+			if pkt.SenderIP.Equal(ip) || (pkt.SenderIP.Equal(net.IPv4zero) && pkt.TargetIP.Equal(ip)) {
+				return &AddressConflictError{IP: ip, HardwareAddr: pkt.SenderHardwareAddr}
+			}
 		}
 	}
+	log.Debug("No conflicts detected for IP address: ", ip)
+	return nil
 }
 
 func (ipManLocal *IPManagerLocal) arpSendGratuitous(iface netlink.Link, addr netlink.Addr) error {
-	for i := 0; i < ipManLocal.conf.RetryNum; i++ {
+	for i := 0; i < ipManLocal.conf().RetryNum; i++ {
 		//TODO: this is not too nice, the "interface" structs used by the netlink and net library are not compatible.
 		interf, _ := net.InterfaceByIndex(iface.Attrs().Index)
 		arpClient, err := arp.Dial(interf)
@@ -238,7 +662,58 @@ func (ipManLocal *IPManagerLocal) arpSendGratuitous(iface netlink.Link, addr net
 				return nil
 			}
 		}
-		time.Sleep(time.Duration(ipManLocal.conf.RetryAfter) * time.Millisecond)
+		time.Sleep(time.Duration(ipManLocal.conf().RetryAfter) * time.Millisecond)
 	}
 	return errors.New("Failed to send gratuitous ARP.")
 }
+
+// ndpSendUnsolicited sends an unsolicited neighbor advertisement (RFC 4861, section 7.2.6) to all nodes,
+// which is the IPv6 equivalent of gratuitous ARP.
+func (ipManLocal *IPManagerLocal) ndpSendUnsolicited(iface netlink.Link, addr netlink.Addr) error {
+	/* The neighbor advertisement consists of the flags (only "override" is set, as this is not a reply to a solicitation),
+	* the target address, and the target link-layer address option (type 2, length in units of 8 bytes).
+	 */
+	body := make([]byte, 4+net.IPv6len+8)
+	body[0] = 0x20
+	copy(body[4:], addr.IP.To16())
+	body[4+net.IPv6len] = 2
+	body[4+net.IPv6len+1] = 1
+	copy(body[4+net.IPv6len+2:], iface.Attrs().HardwareAddr)
+
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeNeighborAdvertisement,
+		Code: 0,
+		Body: &icmp.RawBody{Data: body},
+	}
+	// the kernel calculates the checksum for us.
+	naPackage, err := msg.Marshal(nil)
+	if err != nil {
+		log.Printf("Neighbor advertisement package is malformed: %s", err)
+		return err
+	}
+
+	for i := 0; i < ipManLocal.conf().RetryNum; i++ {
+		conn, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+		if err != nil {
+			log.Printf("Problems with producing the icmpv6 connection: %s", err)
+		} else {
+			// Neighbor discovery messages are only accepted with a hop limit of 255 (RFC 4861, section 7.1.2).
+			cm := &ipv6.ControlMessage{
+				HopLimit: 255,
+				Src:      addr.IP,
+				IfIndex:  iface.Attrs().Index,
+			}
+			dst := &net.IPAddr{IP: net.IPv6linklocalallnodes, Zone: iface.Attrs().Name}
+			_, err = conn.IPv6PacketConn().WriteTo(naPackage, cm, dst)
+			conn.Close()
+			if err != nil {
+				log.Printf("Couldn't send the neighbor advertisement: %s", err)
+			} else {
+				log.Println("Sent unsolicited neighbor advertisement")
+				return nil
+			}
+		}
+		time.Sleep(time.Duration(ipManLocal.conf().RetryAfter) * time.Millisecond)
+	}
+	return errors.New("Failed to send unsolicited neighbor advertisement.")
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"github.com/cybertec-postgresql/yaim/config"
+	"github.com/cybertec-postgresql/yaim/dcs"
+)
+
+// instrumentedDcs counts the errors of all DCS operations that return one,
+// and keeps track of the addresses and nodes it has seen in the DCS.
+type instrumentedDcs struct {
+	dcs.Dcs
+}
+
+// InstrumentDcs returns a Dcs that records metrics about the operations of d.
+func InstrumentDcs(d dcs.Dcs) dcs.Dcs {
+	return &instrumentedDcs{d}
+}
+
+func countError(method string, err error) {
+	if err != nil {
+		DcsErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func (d *instrumentedDcs) AdvertiseInDCS() error {
+	err := d.Dcs.AdvertiseInDCS()
+	countError("AdvertiseInDCS", err)
+	return err
+}
+
+func (d *instrumentedDcs) RefreshMarkIpInDCS(ip string) error {
+	err := d.Dcs.RefreshMarkIpInDCS(ip)
+	countError("RefreshMarkIpInDCS", err)
+	return err
+}
+
+func (d *instrumentedDcs) CheckIpInDCS(ip string) (marked bool, err error) {
+	marked, err = d.Dcs.CheckIpInDCS(ip)
+	countError("CheckIpInDCS", err)
+	return
+}
+
+func (d *instrumentedDcs) MarkIpInDCS(ip string) (success bool, err error) {
+	success, err = d.Dcs.MarkIpInDCS(ip)
+	countError("MarkIpInDCS", err)
+	return
+}
+
+func (d *instrumentedDcs) UnMarkIpInDCS(ip string) error {
+	err := d.Dcs.UnMarkIpInDCS(ip)
+	countError("UnMarkIpInDCS", err)
+	return err
+}
+
+// UnMarkAllIPs unmarks the IPs one by one, so failures are counted just like those of UnMarkIpInDCS.
+func (d *instrumentedDcs) UnMarkAllIPs(ips []string) {
+	for _, ip := range ips {
+		d.UnMarkIpInDCS(ip)
+	}
+}
+
+func (d *instrumentedDcs) ClaimIpInDCS(ip string) (success bool, err error) {
+	success, err = d.Dcs.ClaimIpInDCS(ip)
+	countError("ClaimIpInDCS", err)
+	return
+}
+
+func (d *instrumentedDcs) UnClaimIpInDCS(ip string) error {
+	err := d.Dcs.UnClaimIpInDCS(ip)
+	countError("UnClaimIpInDCS", err)
+	return err
+}
+
+func (d *instrumentedDcs) GetIPs() (IPs, ownMarkedIPs, unmarkedIPs []string, err error) {
+	IPs, ownMarkedIPs, unmarkedIPs, err = d.Dcs.GetIPs()
+	countError("GetIPs", err)
+	if err == nil {
+		PoolIPs.Set(float64(len(IPs)))
+		OwnedIPs.Set(float64(len(ownMarkedIPs)))
+		UnmarkedIPs.Set(float64(len(unmarkedIPs)))
+	}
+	return
+}
+
+func (d *instrumentedDcs) GetIPSpecs() (specs map[string]config.IPSpec, err error) {
+	specs, err = d.Dcs.GetIPSpecs()
+	countError("GetIPSpecs", err)
+	return
+}
+
+func (d *instrumentedDcs) GetPoolState() (*dcs.PoolState, error) {
+	state, err := d.Dcs.GetPoolState()
+	countError("GetPoolState", err)
+	if err == nil {
+		AdvertisedNodes.Set(float64(len(state.Nodes)))
+	}
+	return state, err
+}
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "yaim"
+
+var (
+	HealthChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "health_checks_total",
+		Help:      "Number of health checks by result, which is healthy, unhealthy or error.",
+	}, []string{"result"})
+	HealthCheckDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "health_check_duration_seconds",
+		Help:      "Duration of the health checks.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	Healthy = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "healthy",
+		Help:      "Whether this node is considered healthy, after applying rise and fall.",
+	})
+
+	PoolIPs = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_ips",
+		Help:      "Number of IP addresses in the pool.",
+	})
+	OwnedIPs = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "owned_ips",
+		Help:      "Number of IP addresses marked by this node.",
+	})
+	UnmarkedIPs = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "unmarked_ips",
+		Help:      "Number of IP addresses in the pool that are not marked by any node.",
+	})
+	AdvertisedNodes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "advertised_nodes",
+		Help:      "Number of nodes advertising their healthiness, including nodes in maintenance.",
+	})
+
+	DcsErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dcs_errors_total",
+		Help:      "Number of failed DCS operations by method.",
+	}, []string{"method"})
+
+	AddressOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "address_operations_total",
+		Help:      "Number of addresses added to or deleted from an interface, by operation and result.",
+	}, []string{"operation", "result"})
+	GarpFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "garp_failures_total",
+		Help:      "Number of gratuitous ARP requests or unsolicited neighbor advertisements that could not be sent.",
+	})
+	ExternalAddressChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "external_address_changes_total",
+		Help:      "Number of addresses of yaim removed from an interface, or added to it, by someone else, by change.",
+	}, []string{"change"})
+)
+
+// ObserveHealthCheck records the result of a single health check.
+func ObserveHealthCheck(duration time.Duration, healthy bool, err error) {
+	HealthCheckDuration.Observe(duration.Seconds())
+	switch {
+	case err != nil:
+		HealthChecks.WithLabelValues("error").Inc()
+	case healthy:
+		HealthChecks.WithLabelValues("healthy").Inc()
+	default:
+		HealthChecks.WithLabelValues("unhealthy").Inc()
+	}
+}
+
+// ObserveAddressOperation records the result of adding ("add") or deleting ("delete") an address.
+func ObserveAddressOperation(operation string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	AddressOperations.WithLabelValues(operation, result).Inc()
+}
+
+// Serve exports the metrics on the given address, e.g. ":9105", under the path /metrics.
+// The listener is opened right away, so that errors can be reported during startup.
+func Serve(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		err := http.Serve(listener, mux)
+		log.Error("Metrics listener stopped:")
+		log.Error(err)
+	}()
+	log.Print("Serving metrics on: ", listener.Addr())
+	return nil
+}
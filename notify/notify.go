@@ -0,0 +1,10 @@
+package notify
+
+// Send sends a notification on a channel with a buffer of one, unless there is one pending already.
+// Notifications are coalesced that way, a receiver that is busy will only see one of them.
+func Send(c chan<- struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
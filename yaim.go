@@ -9,20 +9,23 @@ package main
 // Website:	www.cybertec-postgresql.com
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"math"
-	"math/rand"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/cybertec-postgresql/yaim/allocation"
 	"github.com/cybertec-postgresql/yaim/checker"
 	"github.com/cybertec-postgresql/yaim/config"
 	"github.com/cybertec-postgresql/yaim/dcs"
 	"github.com/cybertec-postgresql/yaim/ipmanager"
+	"github.com/cybertec-postgresql/yaim/metrics"
 )
 
 // var configFile = flag.String("config", "./yaim.yml", "Location of the configuration file.")
@@ -49,6 +52,20 @@ func main() {
 		return
 	}
 
+	// the configuration may be replaced on reload, while components that keep running read it.
+	shared := config.NewShared(conf)
+
+	if conf.MetricsAddress != "" {
+		err = metrics.Serve(conf.MetricsAddress)
+		if err != nil {
+			fmt.Println("error while starting metrics listener")
+			fmt.Println(err)
+			return
+		}
+	}
+
+	hysteresis := checker.NewHysteresis(conf)
+
 	checker, err := checker.NewChecker(conf)
 	if err != nil {
 		fmt.Println("error while initiating checker")
@@ -56,74 +73,273 @@ func main() {
 		return
 	}
 
-	dcs, err := dcs.NewDcs(conf)
+	// the API needs to be able to put this node into maintenance.
+	admin, err := dcs.NewAdmin(shared)
 	if err != nil {
 		fmt.Println("error while initiating DCS connector")
 		fmt.Println(err)
 		return
 	}
+	dcs := metrics.InstrumentDcs(admin)
 
-	ipman, err := ipmanager.NewIPManagerLocal(conf)
+	ipman, err := ipmanager.NewIPManager(shared)
 	if err != nil {
 		fmt.Println("error while initiating IP manager")
 		fmt.Println(err)
 		return
 	}
 
-	loop(conf, checker, dcs, ipman)
+	strategy, err := allocation.NewStrategy(conf)
+	if err != nil {
+		fmt.Println("error while initiating allocation strategy")
+		fmt.Println(err)
+		return
+	}
+
+	fence, err := newFencer(conf, ipman)
+	if err != nil {
+		fmt.Println("error while initiating fencing")
+		fmt.Println(err)
+		return
+	}
+
+	api := newAPI(conf, admin)
+	if conf.ApiAddress != "" {
+		err = api.serve()
+		if err != nil {
+			fmt.Println("error while starting API listener")
+			fmt.Println(err)
+			return
+		}
+	}
+
+	loop(shared, checker, hysteresis, dcs, ipman, strategy, fence, api)
 }
 
-func loop(conf *config.Config, checker checker.Checker, dcs dcs.Dcs, ipman ipmanager.IPManagerLocal) {
+func loop(shared *config.Shared, checker checker.Checker, hysteresis *checker.Hysteresis, dcs dcs.Dcs, ipman ipmanager.IPManager, strategy allocation.Strategy, fence *fencer, api *api) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := dcs.Watch(ctx)
+	addrChanges := ipman.Watch(ctx)
+
+	var healthy bool
+	nextCheck := time.Now()
 	for {
-		// time.Sleep(time.Duration(conf.Interval) * time.Millisecond)
 		log.Debug("loop!")
+		conf := shared.Get()
 
-		var err error
-		var healthy bool
-		for i := 0; i < conf.RetryNum; i++ {
-			healthy, err = checker.IsHealthy()
+		// changes in the DCS wake up the loop in between, but the health is only checked once per interval,
+		// so that rise and fall still count the same number of checks.
+		checked := !time.Now().Before(nextCheck)
+		if checked {
+			var err error
+			for i := 0; i < conf.RetryNum; i++ {
+				checkStarted := time.Now()
+				healthy, err = checker.IsHealthy()
+				metrics.ObserveHealthCheck(time.Since(checkStarted), healthy, err)
+				if err != nil {
+					log.Printf("encountered an error while determining health status.\n")
+					log.Print(err)
+				} else {
+					break
+				}
+				time.Sleep(time.Duration(conf.RetryAfter) * time.Millisecond)
+			}
 			if err != nil {
-				log.Printf("encountered an error while determining health status.\n")
-				log.Print(err)
+				log.Print("too many retries")
+			}
+
+			// a single failed (or successful) check doesn't necessarily change the state of the node.
+			state := hysteresis.Update(healthy)
+			if state != healthy {
+				log.Print("Ignoring the result of the health check until it is confirmed: ", hysteresis)
 			} else {
-				break
+				log.Debug("Health state: ", hysteresis)
 			}
-			time.Sleep(time.Duration(conf.RetryAfter) * time.Millisecond)
-		}
-		if err != nil {
-			log.Print("too many retries")
+			healthy = state
+			if healthy {
+				metrics.Healthy.Set(1)
+			} else {
+				metrics.Healthy.Set(0)
+			}
+			_, successes, failures := hysteresis.State()
+			api.update(func(s *status) {
+				s.Healthy = healthy
+				s.Successes = successes
+				s.Failures = failures
+				s.CheckError = ""
+				if err != nil {
+					s.CheckError = err.Error()
+				}
+				s.LastCheck = time.Now()
+			})
 		}
 
+		// the specs are needed to find our addresses, no matter whether we're about to add or drop them.
+		dcsErr := updateIPSpecs(dcs, ipman)
+
 		if healthy == true {
 			log.Print("Node is healthy.")
+			refreshStarted := time.Now()
 			cleanup(conf, dcs, ipman)
-			register(dcs, ipman)
+			if register(conf, dcs, ipman, strategy) {
+				fence.extend(refreshStarted)
+			} else if dcsErr == nil {
+				dcsErr = errors.New("advertisement and marks could not be refreshed")
+			}
 		} else {
 			log.Print("Node is not healthy.")
-			// TODO: make sure to drop addresses here.
-			// we need to keep track of all registered virtual IP addresses, so we can drop them.
-			// This will be useful to know when we stop the program as well.
+			fence.stop()
+			release(dcs, ipman)
+		}
+		if checked {
+			nextCheck = time.Now().Add(time.Duration(conf.Interval) * time.Millisecond)
+		}
+		recordStatus(api, ipman, dcsErr)
+
+		// an unhealthy node has nothing to react to.
+		watch, addrWatch := changes, addrChanges
+		if !healthy {
+			watch, addrWatch = nil, nil
 		}
 		select {
-		// Example. Process to receive a message
-		// case msg := <-receiveMessage():
 		case <-sigs:
-			ipman.DeleteAllIP()
-			_, ownMarkedIPs, _, err := dcs.GetIPs()
+			fence.stop()
+			release(dcs, ipman)
+			return
+		case <-watch:
+			// a single change, e.g. an expired lease, often comes with several others, so they are handled at once.
+			time.Sleep(time.Duration(conf.WatchDebounce) * time.Millisecond)
+			select {
+			case <-changes:
+			default:
+			}
+			log.Debug("Woken up by a change in DCS.")
+		case <-addrWatch:
+			// e.g. flushing an interface removes all of its addresses one by one.
+			time.Sleep(time.Duration(conf.WatchDebounce) * time.Millisecond)
+			select {
+			case <-addrChanges:
+			default:
+			}
+			log.Print("Addresses have been changed by someone else, resyncing immediately.")
+		case <-api.resync:
+			log.Print("Resyncing immediately.")
+		case <-hups:
+			log.Print("Received SIGHUP, reloading configuration.")
+			newChecker, newStrategy, err := reload(shared, hysteresis, fence)
 			if err != nil {
-				log.Error("Cannot retrieve currently marked addresses from DCS for umarking")
-			} else {
-				dcs.UnMarkAllIPs(ownMarkedIPs)
+				log.Error("Keeping the current configuration, reloading failed:")
+				log.Error(err)
+				continue
 			}
-			return
-		case <-time.After(time.Duration(conf.Interval) * time.Millisecond):
+			checker, strategy = newChecker, newStrategy
+			api.setConfig(shared.Get())
+			log.Print("Reloaded configuration, keeping all ip addresses.")
+		case <-time.After(time.Until(nextCheck)):
 		}
 	}
 }
 
-func cleanup(conf *config.Config, dcs dcs.Dcs, ipman ipmanager.IPManagerLocal) {
+// reload reads the configuration again and publishes it to all components through shared,
+// so they use the new settings from their next operation on, e.g. the TTL of the next mark.
+// The checker and the allocation strategy are replaced, the state of the hysteresis and the addresses of this node are kept.
+// Nothing is changed unless the whole configuration is valid.
+func reload(shared *config.Shared, hysteresis *checker.Hysteresis, fence *fencer) (checker.Checker, allocation.Strategy, error) {
+	newConf, err := config.Reload(shared.Get())
+	if err != nil {
+		return nil, nil, err
+	}
+	newChecker, err := checker.NewChecker(newConf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while initiating checker: %w", err)
+	}
+	newStrategy, err := allocation.NewStrategy(newConf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while initiating allocation strategy: %w", err)
+	}
+	err = fence.reconfigure(newConf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while initiating fencing: %w", err)
+	}
+
+	shared.Set(newConf)
+	hysteresis.Reconfigure(newConf)
+	return newChecker, newStrategy, nil
+}
+
+// recordStatus updates the status reported by the API at the end of each iteration of the loop.
+func recordStatus(api *api, ipman ipmanager.IPManager, dcsErr error) {
+	owned := []string{}
+	addrs, err := ipman.GetAllIP()
+	if err != nil {
+		log.Error("encountered an error while checking registered addresses:")
+		log.Error(err)
+	}
+	for _, addr := range addrs {
+		owned = append(owned, addr.IP.String())
+	}
+	now := time.Now()
+	api.update(func(s *status) {
+		if err == nil {
+			s.OwnedIPs = owned
+		}
+		s.DcsConnected = dcsErr == nil
+		s.DcsError = ""
+		if dcsErr != nil {
+			s.DcsError = dcsErr.Error()
+		} else {
+			s.LastDcsSuccess = now
+		}
+		s.LastLoop = now
+	})
+}
+
+// updateIPSpecs passes the specs of all IP addresses from the DCS on to the IP manager.
+// If they can't be retrieved, the IP manager keeps using the previous ones.
+func updateIPSpecs(dcs dcs.Dcs, ipman ipmanager.IPManager) error {
+	specs, err := dcs.GetIPSpecs()
+	if err != nil {
+		log.Error("Error while retrieving the specs of ip addresses:")
+		log.Error(err)
+		return err
+	}
+	ipman.SetIPSpecs(specs)
+	return nil
+}
+
+// release drops all addresses and gives up all marks and the advertisement of this node.
+// Addresses are removed from the interface first and only unmarked once they are gone,
+// so no other node can take them over while they are still in use here.
+func release(dcs dcs.Dcs, ipman ipmanager.IPManager) {
+	ipman.DeleteAllIP()
+
+	_, ownMarkedIPs, _, err := dcs.GetIPs()
+	if err != nil {
+		log.Error("Cannot retrieve currently marked addresses from DCS for umarking")
+		log.Error(err)
+	} else {
+		var releasedIPs []string
+		for _, ip := range ownMarkedIPs {
+			if ipman.CheckIP(ip) == nil {
+				// the mark will expire eventually, but until then, nobody else will add this address.
+				log.Error("IP address: ", ip, " is still registered locally, keeping its mark in DCS.")
+				continue
+			}
+			releasedIPs = append(releasedIPs, ip)
+		}
+		dcs.UnMarkAllIPs(releasedIPs)
+	}
+
+	dcs.UnAdvertiseInDCS()
+}
+
+func cleanup(conf *config.Config, dcs dcs.Dcs, ipman ipmanager.IPManager) {
 	registeredAddresses, err := ipman.GetAllIP()
 	if err != nil {
 		log.Error("encountered an error while checking registered addresses:")
@@ -131,7 +347,8 @@ func cleanup(conf *config.Config, dcs dcs.Dcs, ipman ipmanager.IPManagerLocal) {
 	}
 	for _, address := range registeredAddresses {
 		ip := address.IP.String()
-		marked := dcs.CheckIpInDCS(ip)
+		// errors have been logged by the DCS already.
+		marked, _ := dcs.CheckIpInDCS(ip)
 		if !marked {
 			err := ipman.DeleteIP(ip)
 			if err != nil {
@@ -142,85 +359,194 @@ func cleanup(conf *config.Config, dcs dcs.Dcs, ipman ipmanager.IPManagerLocal) {
 	}
 }
 
-func register(dcs dcs.Dcs, ipman ipmanager.IPManagerLocal) {
-	dcs.AdvertiseInDCS()
-	numAdv, err := dcs.GetNumberAdvertisments()
+// register returns true if the advertisement and all marks of this node have been refreshed successfully.
+// logAddError logs why the IP could not be added, including the MAC address of the host that is still using it.
+func logAddError(ip string, err error) {
+	var conflict *ipmanager.AddressConflictError
+	if errors.As(err, &conflict) {
+		log.Error("Address conflict detected for IP: ", ip, ", it is still in use by the host with MAC: ", conflict.HardwareAddr)
+		return
+	}
+	log.Error("error while adding IP: ", ip, " :")
+	log.Error(err)
+}
+
+// dropIP drops the IP and then its mark, so the address is never in use by two nodes.
+// If the IP can't be dropped, the mark is kept and false is returned.
+func dropIP(dcs dcs.Dcs, ipman ipmanager.IPManager, ip string) bool {
+	err := ipman.DeleteIP(ip)
+	if err != nil && ipman.CheckIP(ip) == nil {
+		log.Error("error while dropping IP: ", ip)
+		log.Error(err)
+		return false
+	}
+	//if the address is gone already, there is nothing left to drop and it must not be registered again.
+	dcs.UnMarkIpInDCS(ip)
+	return true
+}
+
+func register(conf *config.Config, dcs dcs.Dcs, ipman ipmanager.IPManager, strategy allocation.Strategy) (refreshed bool) {
+	err := dcs.AdvertiseInDCS()
 	if err != nil {
-		log.Error("Error while retrieving number of advertising clients:")
+		log.Error("Error while advertising this node:")
 		log.Error(err)
-		return
+		return false
 	}
-	log.Printf("There are %d clients advertising their healthiness.", numAdv)
 
-	//GetNumberMarkedIPs will also refresh all "marked" keys that belong to this nodeName
-	IPs, ownMarkedIPs, unmarkedIPs, err := dcs.GetIPs()
-	numIps := len(IPs)
-	numIpsOptimum := int(math.Ceil(float64(numIps) / float64(numAdv)))
+	IPs, ownMarkedIPs, _, err := dcs.GetIPs()
+	if err != nil {
+		log.Error("Error while retrieving ip addresses:")
+		log.Error(err)
+		return false
+	}
+	state, err := dcs.GetPoolState()
+	if err != nil {
+		log.Error("Error while retrieving the state of the pool:")
+		log.Error(err)
+		return false
+	}
+	// only consider the entries that GetIPs() accepted as valid IP addresses.
+	pool := make(map[string]bool)
+	for _, ip := range IPs {
+		pool[ip] = true
+	}
+	ipStates := state.IPs[:0]
+	holders := make(map[string]string)
+	for _, ip := range state.IPs {
+		if pool[ip.IP] {
+			ipStates = append(ipStates, ip)
+			holders[ip.IP] = ip.Holder
+		}
+	}
+	state.IPs = ipStates
 
-	log.Printf("There are %d ip addresses that can be managed.", numIps)
+	targets := strategy.Assign(state)
+	claims := state.Claims()
+	numTargets := 0
+	for _, node := range targets {
+		if node == conf.Nodename {
+			numTargets++
+		}
+	}
+
+	if state.InMaintenance(conf.Nodename) {
+		log.Print("This node is in maintenance, handing over all ip addresses.")
+	}
+	log.Printf("There are %d clients advertising their healthiness.", len(state.Available()))
+	log.Printf("There are %d ip addresses that can be managed.", len(IPs))
 	log.Printf("There are %d ip addresses managed by this yaim.", len(ownMarkedIPs))
-	log.Printf("We should have %d ip addresses registered to this host.", numIpsOptimum)
+	log.Printf("We should have %d ip addresses registered to this host.", numTargets)
 
-	// if numIpsOptimum == 0 {
-	// 	continue
-	// }
+	//IPs without a target are kept until another node can take them over, but not if that puts two IPs
+	//of the same anti-affinity group on this node.
+	groups := make(map[string]string)
+	for _, ip := range state.IPs {
+		if spec, err := config.ParseIPSpec(ip.Spec); ip.Spec != "" && err == nil {
+			groups[ip.IP] = spec.AntiAffinity
+		}
+	}
+	heldGroups := make(map[string]bool)
+	for _, ip := range ownMarkedIPs {
+		if targets[ip] == conf.Nodename && groups[ip] != "" {
+			heldGroups[groups[ip]] = true
+		}
+	}
 
-	for i := 0; i < len(ownMarkedIPs); i++ {
-		ip := ownMarkedIPs[i]
-		if i < numIpsOptimum {
-			//Check if the IP addresses marked are actually registered
-			err := ipman.CheckIP(ip)
+	var wg sync.WaitGroup
+	refreshErrs := make(chan error, len(ownMarkedIPs))
+	owned := make(map[string]bool)
+	for _, ip := range ownMarkedIPs {
+		owned[ip] = true
+		target := targets[ip]
+		if target != "" && target != conf.Nodename && claims[ip] == target {
+			//The target node has claimed the IP, so it is ready to take it over.
+			//The address needs to be gone before the mark is removed, so it is never in use by two nodes.
+			if dropIP(dcs, ipman, ip) {
+				log.Print("handed over IP: ", ip, " to node: ", target)
+				continue
+			}
+		}
+		if group := groups[ip]; target == "" && group != "" {
+			if heldGroups[group] {
+				if dropIP(dcs, ipman, ip) {
+					log.Print("released IP: ", ip, " as this node already holds another IP of anti-affinity group: ", group)
+					continue
+				}
+			}
+			heldGroups[group] = true
+		}
+		//Check if the IP addresses marked are actually registered
+		err := ipman.CheckIP(ip)
+		if err != nil {
+			log.Error("The marked IP: ", ip, " was not found to be registered locally, registering it again.")
+			// the address might still be registered according to a previous spec.
+			if ipman.DeleteIP(ip) == nil {
+				log.Print("dropped IP: ", ip, " that didn't match its spec.")
+			}
+			//we still hold the mark, so nobody else can have taken over the address in the meantime.
+			err = ipman.AddIP(ip)
 			if err != nil {
-				log.Error("The marked IP: ", ip, " was not found to be registered locally.")
+				logAddError(ip, err)
 				log.Error("Removing mark from DCS.")
 				dcs.UnMarkIpInDCS(ip)
 				//dont refresh the mark.
 				continue
 			}
-			//This will refresh the TTL of all previously marked IPs, except any superflous ones.
-			//The TTL will indirectly "free" all
-			//log.Debug("Trying to refresh mark for IP: " + ip + " in DCS")
-			go dcs.RefreshMarkIpInDCS(ip)
-		} else {
-			//All remaining IPs will need to be removed.
-			//When using Hetzner API, this is not necessary.
-			err := ipman.DeleteIP(ip)
-			if err != nil {
-				log.Error("error while dropping IP: ", ip)
-				log.Error(err)
-			} else {
-				log.Print("dropped IP: ", ip)
-				dcs.UnMarkIpInDCS(ip)
-			}
+			log.Print("registered IP: ", ip, " again")
 		}
+		//Keep the IP until another node is ready to take it over.
+		if target == "" {
+			log.Print("keeping IP: ", ip, " as no other node is able to take it over.")
+		} else if target != conf.Nodename {
+			log.Print("waiting for node: ", target, " to claim IP: ", ip)
+		}
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			refreshErrs <- dcs.RefreshMarkIpInDCS(ip)
+		}(ip)
 	}
 
-	if len(ownMarkedIPs) < numIpsOptimum {
-		// We have too few IPs, try to register another one!
-		// e.g. if 10 adresses and 3 yaim are available and they call this function all at the same time,
-		// each one will try to register ceil(10/3)=4 adresses.
-		// Only the first node will succeed in taking a fourth adress,
-		// the other nodes will get an error from etcd.
+	wg.Wait()
+	close(refreshErrs)
+	refreshed = true
+	for err := range refreshErrs {
+		if err != nil {
+			refreshed = false
+		}
+	}
 
-		if len(unmarkedIPs) <= 0 {
-			log.Print("we should take up more ip-addresses, but it seems like there are no ummarked ones.")
-			log.Print("waiting for other yaim to release their mark or for the TTL to expire.")
-			return
+	for _, ip := range IPs {
+		if targets[ip] != conf.Nodename || owned[ip] {
+			continue
+		}
+		if holders[ip] != "" {
+			//The IP is still held by another node, which will release it once it sees our claim.
+			dcs.ClaimIpInDCS(ip)
+			continue
 		}
-		//select a random IP from unmarkedIPs
-		rand.Seed(time.Now().Unix())
-		ip := unmarkedIPs[rand.Intn(len(unmarkedIPs))]
 
-		//try to mark the randomly select IP. True means we where successful in setting the etcd key.
-		if dcs.MarkIpInDCS(ip) {
+		//try to mark the IP. True means we where successful in setting the etcd key.
+		if marked, _ := dcs.MarkIpInDCS(ip); marked {
+			if claims[ip] == conf.Nodename {
+				dcs.UnClaimIpInDCS(ip)
+			}
 			err := ipman.AddIP(ip)
 			if err != nil {
-				log.Error("error while adding IP: ", ip, " :")
-				log.Error(err)
-				//TODO: think about deleting the key from the DCS straight away. Othwerwise, we'll need to wait for TTL to expire
+				logAddError(ip, err)
+				//release the mark straight away, so we (or others) don't need to wait for the TTL to expire.
+				dcs.UnMarkIpInDCS(ip)
 			} else {
 				log.Print("added IP: ", ip)
 			}
 		}
 	}
+
+	//remove the claims for IPs that are no longer supposed to be taken over by this node.
+	for ip, node := range claims {
+		if node == conf.Nodename && targets[ip] != conf.Nodename {
+			dcs.UnClaimIpInDCS(ip)
+		}
+	}
+	return
 }
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cybertec-postgresql/yaim/allocation"
+	"github.com/cybertec-postgresql/yaim/config"
+	"github.com/cybertec-postgresql/yaim/dcs"
+	"github.com/cybertec-postgresql/yaim/ipmanager"
+)
+
+// fakeDcs keeps the pool in memory, as seen by the node "a".
+type fakeDcs struct {
+	nodes  []string
+	ips    []string
+	specs  map[string]string
+	marks  map[string]string // holder of each address
+	claims map[string]string // node claiming each address
+}
+
+func newFakeDcs(nodes []string, ips ...string) *fakeDcs {
+	return &fakeDcs{
+		nodes:  nodes,
+		ips:    ips,
+		specs:  make(map[string]string),
+		marks:  make(map[string]string),
+		claims: make(map[string]string),
+	}
+}
+
+func (d *fakeDcs) AdvertiseInDCS() error { return nil }
+func (d *fakeDcs) UnAdvertiseInDCS()     {}
+
+func (d *fakeDcs) CheckIpInDCS(ip string) (bool, error) { return d.marks[ip] == "a", nil }
+
+func (d *fakeDcs) MarkIpInDCS(ip string) (bool, error) {
+	if d.marks[ip] != "" {
+		return false, nil
+	}
+	d.marks[ip] = "a"
+	return true, nil
+}
+
+func (d *fakeDcs) RefreshMarkIpInDCS(ip string) error { return nil }
+
+func (d *fakeDcs) UnMarkIpInDCS(ip string) error {
+	if d.marks[ip] == "a" {
+		delete(d.marks, ip)
+	}
+	return nil
+}
+
+func (d *fakeDcs) UnMarkAllIPs(ips []string) {
+	for _, ip := range ips {
+		d.UnMarkIpInDCS(ip)
+	}
+}
+
+func (d *fakeDcs) GetIPs() (IPs, ownMarkedIPs, unmarkedIPs []string, err error) {
+	for _, ip := range d.ips {
+		IPs = append(IPs, ip)
+		switch d.marks[ip] {
+		case "a":
+			ownMarkedIPs = append(ownMarkedIPs, ip)
+		case "":
+			unmarkedIPs = append(unmarkedIPs, ip)
+		}
+	}
+	return
+}
+
+func (d *fakeDcs) GetIPSpecs() (map[string]config.IPSpec, error) { return nil, nil }
+
+func (d *fakeDcs) GetPoolState() (*dcs.PoolState, error) {
+	state := &dcs.PoolState{}
+	for _, ip := range d.ips {
+		state.IPs = append(state.IPs, dcs.IPState{IP: ip, Spec: d.specs[ip], Holder: d.marks[ip], Claim: d.claims[ip]})
+	}
+	for _, node := range d.nodes {
+		value, _ := json.Marshal(dcs.NodeInfo{Weight: 1})
+		state.Nodes = append(state.Nodes, dcs.NodeState{Name: node, Value: string(value)})
+	}
+	return state, nil
+}
+
+func (d *fakeDcs) ClaimIpInDCS(ip string) (bool, error) {
+	d.claims[ip] = "a"
+	return true, nil
+}
+
+func (d *fakeDcs) UnClaimIpInDCS(ip string) error {
+	if d.claims[ip] == "a" {
+		delete(d.claims, ip)
+	}
+	return nil
+}
+
+func (d *fakeDcs) Watch(ctx context.Context) <-chan struct{} { return nil }
+
+// fakeIPManager keeps the registered addresses in memory.
+type fakeIPManager struct {
+	registered map[string]bool
+	addErr     error
+	deleteErr  error
+}
+
+func newFakeIPManager(ips ...string) *fakeIPManager {
+	m := &fakeIPManager{registered: make(map[string]bool)}
+	for _, ip := range ips {
+		m.registered[ip] = true
+	}
+	return m
+}
+
+func (m *fakeIPManager) SetIPSpecs(specs map[string]config.IPSpec) {}
+
+func (m *fakeIPManager) AddIP(ip string) error {
+	if m.addErr != nil {
+		return m.addErr
+	}
+	m.registered[ip] = true
+	return nil
+}
+
+func (m *fakeIPManager) DeleteIP(ip string) error {
+	if m.deleteErr != nil {
+		return m.deleteErr
+	}
+	if !m.registered[ip] {
+		return errors.New("not registered: " + ip)
+	}
+	delete(m.registered, ip)
+	return nil
+}
+
+func (m *fakeIPManager) CheckIP(ip string) error {
+	if !m.registered[ip] {
+		return errors.New("not registered: " + ip)
+	}
+	return nil
+}
+
+func (m *fakeIPManager) GetAllIP() ([]*net.IPNet, error)           { return nil, nil }
+func (m *fakeIPManager) DeleteAllIP()                              {}
+func (m *fakeIPManager) Watch(ctx context.Context) <-chan struct{} { return nil }
+
+// addresses returns the registered addresses in order.
+func (m *fakeIPManager) addresses() []string {
+	var ips []string
+	for ip := range m.registered {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func runRegister(t *testing.T, d *fakeDcs, m *fakeIPManager) {
+	t.Helper()
+	conf := &config.Config{Nodename: "a", Weight: 1}
+	strategy, err := allocation.NewBalancedStrategy(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register(conf, d, m, strategy)
+}
+
+func TestRegisterHandsOverClaimedAddress(t *testing.T) {
+	tests := []struct {
+		name       string
+		registered []string
+		deleteErr  error
+		wantMarks  map[string]string
+		wantLocal  []string
+	}{
+		{
+			name:       "address is dropped before its mark",
+			registered: []string{"10.0.0.1", "10.0.0.2"},
+			wantMarks:  map[string]string{"10.0.0.1": "a"},
+			wantLocal:  []string{"10.0.0.1"},
+		},
+		{
+			name:       "address that is gone already is not registered again",
+			registered: []string{"10.0.0.1"},
+			deleteErr:  errors.New("no such address"),
+			wantMarks:  map[string]string{"10.0.0.1": "a"},
+			wantLocal:  []string{"10.0.0.1"},
+		},
+		{
+			name:       "address that can't be dropped keeps its mark",
+			registered: []string{"10.0.0.1", "10.0.0.2"},
+			deleteErr:  errors.New("permission denied"),
+			wantMarks:  map[string]string{"10.0.0.1": "a", "10.0.0.2": "a"},
+			wantLocal:  []string{"10.0.0.1", "10.0.0.2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeDcs([]string{"a", "b"}, "10.0.0.1", "10.0.0.2")
+			d.marks["10.0.0.1"] = "a"
+			d.marks["10.0.0.2"] = "a"
+			d.claims["10.0.0.2"] = "b"
+			m := newFakeIPManager(tt.registered...)
+			m.deleteErr = tt.deleteErr
+
+			runRegister(t, d, m)
+
+			if !reflect.DeepEqual(d.marks, tt.wantMarks) {
+				t.Errorf("got marks %v, want %v", d.marks, tt.wantMarks)
+			}
+			if got := m.addresses(); !reflect.DeepEqual(got, tt.wantLocal) {
+				t.Errorf("got registered addresses %v, want %v", got, tt.wantLocal)
+			}
+		})
+	}
+}
+
+func TestRegisterWaitsForClaim(t *testing.T) {
+	d := newFakeDcs([]string{"a", "b"}, "10.0.0.1", "10.0.0.2")
+	d.marks["10.0.0.1"] = "a"
+	d.marks["10.0.0.2"] = "a"
+	m := newFakeIPManager("10.0.0.1", "10.0.0.2")
+
+	runRegister(t, d, m)
+
+	// without a claim, the other node might not be ready to take over the address yet.
+	want := map[string]string{"10.0.0.1": "a", "10.0.0.2": "a"}
+	if !reflect.DeepEqual(d.marks, want) {
+		t.Errorf("got marks %v, want %v", d.marks, want)
+	}
+}
+
+func TestRegisterKeepsOneAddressPerAntiAffinityGroup(t *testing.T) {
+	// a single node can only take one address of the group, the other one is left without a target.
+	d := newFakeDcs([]string{"a"}, "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	for _, ip := range d.ips {
+		d.marks[ip] = "a"
+	}
+	d.specs["10.0.0.1"] = `{"anti-affinity": "db"}`
+	d.specs["10.0.0.2"] = `{"anti-affinity": "db"}`
+	m := newFakeIPManager(d.ips...)
+
+	runRegister(t, d, m)
+
+	want := map[string]string{"10.0.0.1": "a", "10.0.0.3": "a"}
+	if !reflect.DeepEqual(d.marks, want) {
+		t.Errorf("got marks %v, want %v", d.marks, want)
+	}
+	if got := m.addresses(); !reflect.DeepEqual(got, []string{"10.0.0.1", "10.0.0.3"}) {
+		t.Errorf("got registered addresses %v, want [10.0.0.1 10.0.0.3]", got)
+	}
+}
+
+func TestRegisterReleasesConflictingAddress(t *testing.T) {
+	conflict := &ipmanager.AddressConflictError{IP: net.ParseIP("10.0.0.1"), HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}}
+	tests := []struct {
+		name  string
+		marks map[string]string
+	}{
+		{
+			name: "newly marked address",
+		},
+		{
+			name:  "marked address that is registered again",
+			marks: map[string]string{"10.0.0.1": "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFakeDcs([]string{"a"}, "10.0.0.1")
+			for ip, holder := range tt.marks {
+				d.marks[ip] = holder
+			}
+			m := newFakeIPManager()
+			m.addErr = fmt.Errorf("probing failed: %w", conflict)
+
+			runRegister(t, d, m)
+
+			if len(d.marks) != 0 {
+				t.Errorf("mark of the conflicting address kept: %v", d.marks)
+			}
+			if got := m.addresses(); len(got) != 0 {
+				t.Errorf("conflicting address registered: %v", got)
+			}
+		})
+	}
+}